@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
@@ -17,13 +18,14 @@ import (
 )
 
 var config struct {
-	server string
-	port   int
-	passwd string
-	method string
-	core   int
-	nconn  int
-	nreq   int
+	server  string
+	port    int
+	passwd  string
+	method  string
+	core    int
+	nconn   int
+	nreq    int
+	timeout time.Duration
 	// nsec   int
 }
 
@@ -56,13 +58,13 @@ func get(connid int, uri, serverAddr string, rawAddr []byte, cipher *ss.Cipher,
 		done <- reqTime[:reqDone]
 	}()
 	tr := &http.Transport{
-		Dial: func(_, _ string) (net.Conn, error) {
-			return ss.DialWithRawAddr(rawAddr, serverAddr, cipher.Copy())
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return ss.DialWithRawAddrContext(ctx, rawAddr, serverAddr, cipher.Copy())
 		},
 	}
 
 	buf := make([]byte, 8192)
-	client := &http.Client{Transport: tr}
+	client := &http.Client{Transport: tr, Timeout: config.timeout}
 	for ; reqDone < config.nreq; reqDone++ {
 		start := time.Now()
 		if err := doOneRequest(client, uri, buf); err != nil {
@@ -84,6 +86,7 @@ func main() {
 	flag.StringVar(&config.method, "m", "", "encryption method, use empty string or rc4")
 	flag.IntVar(&config.nconn, "nc", 1, "number of connection to server")
 	flag.IntVar(&config.nreq, "nr", 1, "number of request for each connection")
+	flag.DurationVar(&config.timeout, "t", 30*time.Second, "timeout for each request")
 	// flag.IntVar(&config.nsec, "ns", 0, "run how many seconds for each connection")
 	flag.BoolVar((*bool)(&debug), "d", false, "print http response body for debugging")
 
@@ -1,18 +1,20 @@
 package main
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
@@ -20,356 +22,291 @@ import (
 
 var debug ss.DebugLog
 
-var (
-	errAddrType      = errors.New("socks addr type not supported")
-	errVer           = errors.New("socks version not supported")
-	errMethod        = errors.New("socks only support 1 method now")
-	errAuthExtraData = errors.New("socks authentication get extra data")
-	errReqExtraData  = errors.New("socks request get extra data")
-	errCmd           = errors.New("socks command not supported")
-)
-
-const (
-	socksVer5       = 5
-	socksCmdConnect = 1
-)
+// parseServerConfig returns the servers of the config followed by those of
+// the subscription, skipping those with a plugin, and the server groups.
+func parseServerConfig(config *ss.Config, sub []*ss.ServerURI) ([]*ss.Upstream, map[string][]*ss.Upstream, error) {
+	var extra []*ss.ServerURI
+	for _, u := range sub {
+		if u.Plugin != "" {
+			ss.Warnf("ignore subscription server %s, plugins are not supported", u.Server)
+			continue
+		}
+		extra = append(extra, u)
+	}
+	upstreams, err := config.Upstreams(extra...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed generating ciphers: %v", err)
+	}
+	groups, err := config.Groups(upstreams)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(upstreams) == 0 {
+		return nil, nil, errors.New("no server available")
+	}
+	for _, se := range upstreams {
+		ss.Infof("available remote server %s", se.Server)
+	}
+	return upstreams, groups, nil
+}
 
-func init() {
-	rand.Seed(time.Now().Unix())
+// fetchSubscription returns the servers of the subscription, from the copy
+// of the last list if it can't be fetched.
+func fetchSubscription(sub *ss.Subscription) ([]*ss.ServerURI, error) {
+	servers, _, err := sub.Fetch(context.Background())
+	if err == nil || sub.CachePath == "" {
+		return servers, err
+	}
+	ss.Warnf("error fetching subscription: %v, using the copy in %s", err, sub.CachePath)
+	return sub.Load()
 }
 
-func handShake(conn net.Conn) (err error) {
-	const (
-		idVer     = 0
-		idNmethod = 1
-	)
-	// version identification and method selection message in theory can have
-	// at most 256 methods, plus version and nmethod field in total 258 bytes
-	// the current rfc defines only 3 authentication methods (plus 2 reserved),
-	// so it won't be such long in practice
-
-	buf := make([]byte, 258)
-
-	var n int
-	ss.SetReadTimeout(conn)
-	// make sure we get the nmethod field
-	if n, err = io.ReadAtLeast(conn, buf, idNmethod+1); err != nil {
-		return
-	}
-	if buf[idVer] != socksVer5 {
-		return errVer
-	}
-	nmethod := int(buf[idNmethod])
-	msgLen := nmethod + 2
-	if n == msgLen { // handshake done, common case
-		// do nothing, jump directly to send confirmation
-	} else if n < msgLen { // has more methods to read, rare case
-		if _, err = io.ReadFull(conn, buf[n:msgLen]); err != nil {
-			return
-		}
-	} else { // error, should not get extra data
-		return errAuthExtraData
+func runHTTP(proto, listenAddr string, h http.Handler) {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		ss.Fatalf("%v", err)
+	}
+	ss.Infof("starting local %s at %v ...", proto, listenAddr)
+	if err = http.Serve(ln, h); err != nil {
+		ss.Fatalf("%v", err)
 	}
-	// send confirmation: version 5, no authentication required
-	_, err = conn.Write([]byte{socksVer5, 0})
-	return
 }
 
-func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
-	const (
-		idVer   = 0
-		idCmd   = 1
-		idType  = 3 // address type index
-		idIP0   = 4 // ip addres start index
-		idDmLen = 4 // domain address length index
-		idDm0   = 5 // domain address start index
-
-		typeIPv4 = 1 // type is ipv4 address
-		typeDm   = 3 // type is domain address
-		typeIPv6 = 4 // type is ipv6 address
-
-		lenIPv4   = 3 + 1 + net.IPv4len + 2 // 3(ver+cmd+rsv) + 1addrType + ipv4 + 2port
-		lenIPv6   = 3 + 1 + net.IPv6len + 2 // 3(ver+cmd+rsv) + 1addrType + ipv6 + 2port
-		lenDmBase = 3 + 1 + 1 + 2           // 3 + 1addrType + 1addrLen + 2port, plus addrLen
-	)
-	// refer to getRequest in server.go for why set buffer size to 263
-	buf := make([]byte, 263)
-	var n int
-	ss.SetReadTimeout(conn)
-	// read till we get possible domain length field
-	if n, err = io.ReadAtLeast(conn, buf, idDmLen+1); err != nil {
-		return
-	}
-	// check version and cmd
-	if buf[idVer] != socksVer5 {
-		err = errVer
-		return
-	}
-	if buf[idCmd] != socksCmdConnect {
-		err = errCmd
-		return
-	}
-
-	reqLen := -1
-	switch buf[idType] {
-	case typeIPv4:
-		reqLen = lenIPv4
-	case typeIPv6:
-		reqLen = lenIPv6
-	case typeDm:
-		reqLen = int(buf[idDmLen]) + lenDmBase
-	default:
-		err = errAddrType
-		return
-	}
-
-	if n == reqLen {
-		// common case, do nothing
-	} else if n < reqLen { // rare case
-		if _, err = io.ReadFull(conn, buf[n:reqLen]); err != nil {
-			return
-		}
-	} else {
-		err = errReqExtraData
-		return
+func run(proto, listenAddr string, local *ss.Local) {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		ss.Fatalf("%v", err)
+	}
+	ss.Infof("starting local %s at %v ...", proto, listenAddr)
+	if err = local.Serve(ln); err != nil {
+		ss.Fatalf("%v", err)
 	}
+}
 
-	rawaddr = buf[idType:reqLen]
+func enoughOptions(config *ss.Config) bool {
+	return config.Server != nil && config.ServerPort != 0 &&
+		hasLocalPort(config) && config.Password != ""
+}
 
-	if debug {
-		switch buf[idType] {
-		case typeIPv4:
-			host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
-		case typeIPv6:
-			host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
-		case typeDm:
-			host = string(buf[idDm0 : idDm0+buf[idDmLen]])
-		}
-		port := binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])
-		host = net.JoinHostPort(host, strconv.Itoa(int(port)))
-	}
+func hasLocalPort(config *ss.Config) bool {
+	return config.LocalPort != 0 || config.LocalHTTPPort != 0 ||
+		config.LocalRedirPort != 0 || config.LocalTProxyPort != 0 ||
+		len(config.Tunnels) != 0 || config.LocalDNSPort != 0
+}
 
-	return
+// tunnelFlag collects the values of the repeatable -L option.
+type tunnelFlag []string
+
+func (f *tunnelFlag) String() string {
+	return strings.Join(*f, ",")
 }
 
-type ServerCipher struct {
-	server string
-	cipher *ss.Cipher
+func (f *tunnelFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
 }
 
-var servers struct {
-	srvCipher []*ServerCipher
-	failCnt   []int // failed connection count
+func runTProxyUDP(listenAddr string, local *ss.Local) {
+	conn, err := ss.ListenTProxyUDP(listenAddr)
+	if err != nil {
+		ss.Fatalf("%v", err)
+	}
+	ss.Infof("starting local udp transparent proxy at %v ...", listenAddr)
+	if err = local.ServeTProxyUDP(conn); err != nil {
+		ss.Fatalf("%v", err)
+	}
 }
 
-func parseServerConfig(config *ss.Config) {
-	hasPort := func(s string) bool {
-		_, port, err := net.SplitHostPort(s)
-		if err != nil {
-			return false
-		}
-		return port != ""
+func runTunnelUDP(listenAddr, target string, local *ss.Local) {
+	conn, err := net.ListenPacket("udp", listenAddr)
+	if err != nil {
+		ss.Fatalf("%v", err)
 	}
+	ss.Infof("starting local udp tunnel to %s at %v ...", target, listenAddr)
+	if err = local.ServeTunnelUDP(conn, target); err != nil {
+		ss.Fatalf("%v", err)
+	}
+}
 
-	if len(config.ServerPassword) == 0 {
-		method := config.Method
-		if config.Auth {
-			method += "-auth"
-		}
-		// only one encryption table
-		cipher, err := ss.NewCipher(method, config.Password)
-		if err != nil {
-			log.Fatal("Failed generating ciphers:", err)
-		}
-		srvPort := strconv.Itoa(config.ServerPort)
-		srvArr := config.GetServerArray()
-		n := len(srvArr)
-		servers.srvCipher = make([]*ServerCipher, n)
-
-		for i, s := range srvArr {
-			if hasPort(s) {
-				log.Println("ignore server_port option for server", s)
-				servers.srvCipher[i] = &ServerCipher{s, cipher}
-			} else {
-				servers.srvCipher[i] = &ServerCipher{net.JoinHostPort(s, srvPort), cipher}
-			}
-		}
-	} else {
-		// multiple servers
-		n := len(config.ServerPassword)
-		servers.srvCipher = make([]*ServerCipher, n)
-
-		cipherCache := make(map[string]*ss.Cipher)
-		i := 0
-		for _, serverInfo := range config.ServerPassword {
-			if len(serverInfo) < 2 || len(serverInfo) > 3 {
-				log.Fatalf("server %v syntax error\n", serverInfo)
-			}
-			server := serverInfo[0]
-			passwd := serverInfo[1]
-			encmethod := ""
-			if len(serverInfo) == 3 {
-				encmethod = serverInfo[2]
-			}
-			if !hasPort(server) {
-				log.Fatalf("no port for server %s\n", server)
-			}
-			// Using "|" as delimiter is safe here, since no encryption
-			// method contains it in the name.
-			cacheKey := encmethod + "|" + passwd
-			cipher, ok := cipherCache[cacheKey]
-			if !ok {
-				var err error
-				cipher, err = ss.NewCipher(encmethod, passwd)
-				if err != nil {
-					log.Fatal("Failed generating ciphers:", err)
-				}
-				cipherCache[cacheKey] = cipher
-			}
-			servers.srvCipher[i] = &ServerCipher{server, cipher}
-			i++
-		}
+func runDNSUDP(listenAddr string, local *ss.Local, h *ss.DNSHandler) {
+	conn, err := net.ListenPacket("udp", listenAddr)
+	if err != nil {
+		ss.Fatalf("%v", err)
 	}
-	servers.failCnt = make([]int, len(servers.srvCipher))
-	for _, se := range servers.srvCipher {
-		log.Println("available remote server", se.server)
+	ss.Infof("starting local udp dns server at %v ...", listenAddr)
+	if err = local.ServeDNS(conn, h); err != nil {
+		ss.Fatalf("%v", err)
 	}
-	return
 }
 
-func connectToServer(serverId int, rawaddr []byte, addr string) (remote *ss.Conn, err error) {
-	se := servers.srvCipher[serverId]
-	remote, err = ss.DialWithRawAddr(rawaddr, se.server, se.cipher.Copy())
+// parseFile parses the file at path with parse.
+func parseFile(path string, parse func(io.Reader) ([]*ss.Rule, error)) ([]*ss.Rule, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Println("error connecting to shadowsocks server:", err)
-		const maxFailCnt = 30
-		if servers.failCnt[serverId] < maxFailCnt {
-			servers.failCnt[serverId]++
-		}
 		return nil, err
 	}
-	debug.Printf("connected to %s via %s\n", addr, se.server)
-	servers.failCnt[serverId] = 0
-	return
+	defer f.Close()
+	rules, err := parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rules, nil
 }
 
-// Connection to the server in the order specified in the config. On
-// connection failure, try the next server. A failed server will be tried with
-// some probability according to its fail count, so we can discover recovered
-// servers.
-func createServerConn(rawaddr []byte, addr string) (remote *ss.Conn, err error) {
-	const baseFailCnt = 20
-	n := len(servers.srvCipher)
-	skipped := make([]int, 0)
-	for i := 0; i < n; i++ {
-		// skip failed server, but try it with some probability
-		if servers.failCnt[i] > 0 && rand.Intn(servers.failCnt[i]+baseFailCnt) != 0 {
-			skipped = append(skipped, i)
-			continue
-		}
-		remote, err = connectToServer(i, rawaddr, addr)
-		if err == nil {
-			return
-		}
+// loadRules reads the rule file at path, checking the server groups used by
+// the rules exist, and GEOIP rules have a database.
+func loadRules(path string, groups map[string][]*ss.Upstream, geoip *ss.GeoIP) ([]*ss.Rule, error) {
+	rules, err := parseFile(path, ss.ParseRules)
+	if err != nil {
+		return nil, err
 	}
-	// last resort, try skipped servers, not likely to succeed
-	for _, i := range skipped {
-		remote, err = connectToServer(i, rawaddr, addr)
-		if err == nil {
-			return
+	for _, r := range rules {
+		if r.Group != "" && len(groups[r.Group]) == 0 {
+			return nil, fmt.Errorf("%s: rule line %d: unknown server group %s", path, r.Line, r.Group)
+		}
+		if r.Type == "GEOIP" && geoip == nil {
+			return nil, fmt.Errorf("%s: rule line %d: GEOIP rule without geoip_database", path, r.Line)
 		}
 	}
-	return nil, err
+	return rules, nil
 }
 
-func handleConnection(conn net.Conn) {
-	if debug {
-		debug.Printf("socks connect from %s\n", conn.RemoteAddr().String())
+// pacRules returns the rules of the PAC file, see the local_pac_port option.
+func pacRules(config *ss.Config, rules []*ss.Rule) ([]*ss.Rule, error) {
+	var pac []*ss.Rule
+	lists := []struct {
+		path   string
+		action ss.RuleAction
+	}{
+		{config.PACDirectDomains, ss.ActionDirect},
+		{config.PACProxyDomains, ss.ActionProxy},
 	}
-	closed := false
-	defer func() {
-		if !closed {
-			conn.Close()
+	for _, list := range lists {
+		if list.path == "" {
+			continue
 		}
-	}()
-
-	var err error = nil
-	if err = handShake(conn); err != nil {
-		log.Println("socks handshake:", err)
-		return
+		action := list.action
+		r, err := parseFile(list.path, func(rd io.Reader) ([]*ss.Rule, error) {
+			return ss.ParseDomainList(rd, action)
+		})
+		if err != nil {
+			return nil, err
+		}
+		pac = append(pac, r...)
 	}
-	rawaddr, addr, err := getRequest(conn)
-	if err != nil {
-		log.Println("error getting request:", err)
-		return
+	if config.GFWList != "" {
+		r, err := parseFile(config.GFWList, ss.ParseGFWList)
+		if err != nil {
+			return nil, err
+		}
+		pac = append(pac, r...)
 	}
-	// Sending connection established message immediately to client.
-	// This some round trip time for creating socks connection with the client.
-	// But if connection failed, the client will get connection reset error.
-	_, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x43})
-	if err != nil {
-		debug.Println("send connection confirmation:", err)
-		return
+	pac = append(pac, rules...)
+	if config.PACDefault == "direct" {
+		pac = append(pac, &ss.Rule{Type: "MATCH", Action: ss.ActionDirect})
 	}
+	return pac, nil
+}
 
-	remote, err := createServerConn(rawaddr, addr)
-	if err != nil {
-		if len(servers.srvCipher) > 1 {
-			log.Println("Failed connect to all avaiable shadowsocks server")
+// loadAll loads the rules of router and pac, which may be nil. Without rule
+// file, router has no rules and proxies all connections. Nothing is changed
+// on error.
+func loadAll(config *ss.Config, groups map[string][]*ss.Upstream, router *ss.Router, pac *ss.PACHandler) error {
+	var rules []*ss.Rule
+	if config.Rules != "" {
+		var err error
+		if rules, err = loadRules(config.Rules, groups, router.GeoIP); err != nil {
+			return err
 		}
-		return
 	}
-	defer func() {
-		if !closed {
-			remote.Close()
+	if pac != nil {
+		r, err := pacRules(config, rules)
+		if err != nil {
+			return err
 		}
-	}()
-
-	go ss.PipeThenClose(conn, remote)
-	ss.PipeThenClose(remote, conn)
-	closed = true
-	debug.Println("closed connection to", addr)
+		pac.SetRules(r)
+	}
+	router.SetRules(rules)
+	if config.Rules != "" {
+		ss.Infof("loaded %d rules from %s", len(rules), config.Rules)
+	}
+	return nil
 }
 
-func run(listenAddr string) {
-	ln, err := net.Listen("tcp", listenAddr)
+// readConfig reads the config file, the options given on the command line
+// replacing those of the file. A server given as an ss:// URI replaces the
+// servers of the file.
+func readConfig(configFile string, cmdConfig *ss.Config, cmdServer string) (*ss.Config, error) {
+	config, err := ss.ParseConfig(configFile)
 	if err != nil {
-		log.Fatal(err)
-	}
-	log.Printf("starting local socks5 server at %v ...\n", listenAddr)
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Println("accept:", err)
-			continue
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error reading %s: %v", configFile, err)
 		}
-		go handleConnection(conn)
+		c := *cmdConfig
+		config = &c
+	} else {
+		ss.UpdateConfig(config, cmdConfig)
+	}
+	if strings.HasPrefix(cmdServer, "ss://") {
+		config.Server = nil
+		config.ServerPassword = nil
+		config.ServerURIs = []string{cmdServer}
+	}
+	if config.Method == "" {
+		config.Method = "aes-256-cfb"
 	}
+	return config, nil
 }
 
-func enoughOptions(config *ss.Config) bool {
-	return config.Server != nil && config.ServerPort != 0 &&
-		config.LocalPort != 0 && config.Password != ""
+// waitSignal calls reload on SIGHUP.
+func waitSignal(reload func() error) {
+	var sigChan = make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		ss.Infof("reloading config")
+		if err := reload(); err != nil {
+			ss.Errorf("error reloading config, keeping the current one: %v", err)
+			continue
+		}
+		ss.Infof("config reloaded")
+	}
 }
 
 func main() {
-	log.SetOutput(os.Stdout)
-
 	var configFile, cmdServer, cmdLocal string
 	var cmdConfig ss.Config
-	var printVer bool
+	var printVer, authRequired, deferReply, geoipResolve bool
 
 	flag.BoolVar(&printVer, "version", false, "print version")
 	flag.StringVar(&configFile, "c", "config.json", "specify config file")
-	flag.StringVar(&cmdServer, "s", "", "server address")
+	flag.StringVar(&cmdServer, "s", "", "server address, or ss:// URI replacing the servers of the config file")
 	flag.StringVar(&cmdLocal, "b", "", "local address, listen only to this address if specified")
 	flag.StringVar(&cmdConfig.Password, "k", "", "password")
 	flag.IntVar(&cmdConfig.ServerPort, "p", 0, "server port")
 	flag.IntVar(&cmdConfig.Timeout, "t", 300, "timeout in seconds")
-	flag.IntVar(&cmdConfig.LocalPort, "l", 0, "local socks5 proxy port")
+	flag.IntVar(&cmdConfig.LocalPort, "l", 0, "local proxy port, serving socks5, socks4 and http")
+	flag.IntVar(&cmdConfig.LocalHTTPPort, "http-port", 0, "local http proxy port")
+	flag.IntVar(&cmdConfig.LocalRedirPort, "redir-port", 0, "local transparent proxy port for iptables REDIRECT, linux only")
+	flag.Var((*tunnelFlag)(&cmdConfig.Tunnels), "L", "forward [listen_host:]port=target_host:port through the server for tcp and udp, can be repeated")
+	flag.IntVar(&cmdConfig.LocalDNSPort, "dns-port", 0, "local dns port, queries are resolved through the server")
+	flag.IntVar(&cmdConfig.LocalTProxyPort, "tproxy-port", 0, "local udp transparent proxy port for iptables TPROXY, linux only")
+	flag.IntVar(&cmdConfig.ConnectTimeout, "connect-timeout", 0, "timeout in seconds for connecting to a server, default: no timeout")
+	flag.StringVar(&cmdConfig.Balance, "balance", "", "server selection: failover, round-robin, weighted, least-conn, latency or hash, default: failover")
+	flag.StringVar(&cmdConfig.SubscriptionURL, "subscription", "", "URL of a SIP008 online server list")
+	flag.StringVar(&cmdConfig.HealthCheckURL, "health-check", "", "http URL fetched through each server to check it's up")
+	flag.IntVar(&cmdConfig.LocalStatusPort, "status-port", 0, "local port serving the state of the servers as JSON")
 	flag.StringVar(&cmdConfig.Method, "m", "", "encryption method, default: aes-256-cfb")
 	flag.BoolVar((*bool)(&debug), "d", false, "print debug message")
+	flag.StringVar(&cmdConfig.LogLevel, "log-level", "", "log level: error, warn, info, debug or trace, default: info")
+	flag.StringVar(&cmdConfig.LogFormat, "log-format", "", "log format: text or json, default: text")
 	flag.BoolVar(&cmdConfig.Auth, "A", false, "one time auth")
+	flag.StringVar(&cmdConfig.Rules, "rules", "", "routing rule file, reloaded on SIGHUP")
+	flag.StringVar(&cmdConfig.GeoIPDatabase, "geoip", "", "MaxMind database (.mmdb) for GEOIP rules")
+	flag.BoolVar(&geoipResolve, "geoip-resolve", false, "resolve domain names locally for GEOIP rules")
+	flag.IntVar(&cmdConfig.LocalPACPort, "pac-port", 0, "local port serving the proxy auto-config file")
+	flag.StringVar(&cmdConfig.GFWList, "gfwlist", "", "gfwlist file, proxied domains of the PAC file")
+	flag.BoolVar(&authRequired, "socks-auth", false, "require socks5 and http proxy authentication with local_users")
+	flag.BoolVar(&deferReply, "socks-defer-reply", false, "reply to socks5 requests once connected, with an error code on failure")
 
 	flag.Parse()
 
@@ -378,8 +315,9 @@ func main() {
 		os.Exit(0)
 	}
 
-	cmdConfig.Server = cmdServer
-	ss.SetDebug(debug)
+	if !strings.HasPrefix(cmdServer, "ss://") {
+		cmdConfig.Server = cmdServer
+	}
 
 	if strings.HasSuffix(cmdConfig.Method, "-auth") {
 		cmdConfig.Method = cmdConfig.Method[:len(cmdConfig.Method)-5]
@@ -393,38 +331,257 @@ func main() {
 	if (!exists || err != nil) && binDir != "" && binDir != "." {
 		oldConfig := configFile
 		configFile = path.Join(binDir, "config.json")
-		log.Printf("%s not found, try config file %s\n", oldConfig, configFile)
+		ss.Infof("%s not found, try config file %s", oldConfig, configFile)
 	}
 
-	config, err := ss.ParseConfig(configFile)
+	config, err := readConfig(configFile, &cmdConfig, cmdServer)
 	if err != nil {
-		config = &cmdConfig
-		if !os.IsNotExist(err) {
-			fmt.Fprintf(os.Stderr, "error reading %s: %v\n", configFile, err)
-			os.Exit(1)
-		}
-	} else {
-		ss.UpdateConfig(config, &cmdConfig)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	if config.Method == "" {
-		config.Method = "aes-256-cfb"
+	if err = config.SetupLogger(os.Stdout, bool(debug)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	if len(config.ServerPassword) == 0 {
+	if len(config.ServerPassword) == 0 && len(config.ServerURIs) == 0 && config.SubscriptionURL == "" {
 		if !enoughOptions(config) {
 			fmt.Fprintln(os.Stderr, "must specify server address, password and both server/local port")
 			os.Exit(1)
 		}
 	} else {
 		if config.Password != "" || config.ServerPort != 0 || config.GetServerArray() != nil {
-			fmt.Fprintln(os.Stderr, "given server_password, ignore server, server_port and password option:", config)
+			fmt.Fprintln(os.Stderr, "given server_password, server_uris or subscription_url, ignore server, server_port and password option:", config)
 		}
-		if config.LocalPort == 0 {
+		if !hasLocalPort(config) {
 			fmt.Fprintln(os.Stderr, "must specify local port")
 			os.Exit(1)
 		}
 	}
 
-	parseServerConfig(config)
+	if authRequired {
+		config.LocalAuthRequired = true
+	}
+	if deferReply {
+		config.LocalSOCKSDeferReply = true
+	}
+	if geoipResolve {
+		config.GeoIPResolve = true
+	}
+	if config.LocalAuthRequired && len(config.LocalUsers) == 0 {
+		fmt.Fprintln(os.Stderr, "authentication required but no local_users given")
+		os.Exit(1)
+	}
+	if config.LocalPACPort != 0 && config.LocalPort == 0 && config.LocalHTTPPort == 0 {
+		fmt.Fprintln(os.Stderr, "local_pac_port given but no local_port or local_http_port")
+		os.Exit(1)
+	}
+	if config.PACDefault != "" && config.PACDefault != "proxy" && config.PACDefault != "direct" {
+		fmt.Fprintln(os.Stderr, "pac_default must be proxy or direct")
+		os.Exit(1)
+	}
+	if len(config.DNSDirectDomains) != 0 && len(config.DNSDirectResolvers) == 0 {
+		fmt.Fprintln(os.Stderr, "dns_direct_domains given but no dns_direct_resolvers")
+		os.Exit(1)
+	}
+	type tunnel struct{ listen, target string }
+	var tunnels []tunnel
+	for _, spec := range config.Tunnels {
+		listen, target, err := ss.ParseTunnel(spec)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if host, port, _ := net.SplitHostPort(listen); host == "" {
+			listen = cmdLocal + ":" + port
+		}
+		tunnels = append(tunnels, tunnel{listen, target})
+	}
+
+	var sub *ss.Subscription
+	var subServers []*ss.ServerURI
+	if config.SubscriptionURL != "" {
+		sub = &ss.Subscription{
+			URL:       config.SubscriptionURL,
+			CachePath: config.SubscriptionCache,
+			Interval:  time.Duration(config.SubscriptionInterval) * time.Second,
+		}
+		if subServers, err = fetchSubscription(sub); err != nil {
+			fmt.Fprintln(os.Stderr, "error fetching subscription:", err)
+			os.Exit(1)
+		}
+	}
+	servers, groups, err := parseServerConfig(config, subServers)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	list := ss.NewServerList(servers, groups)
+	// mu serializes the updates of the servers from the subscription and the
+	// reloads on SIGHUP, which both replace current and the server list
+	var mu sync.Mutex
+	current := config
+	if sub != nil {
+		go sub.Run(context.Background(), func(uris []*ss.ServerURI) {
+			mu.Lock()
+			defer mu.Unlock()
+			servers, groups, err := parseServerConfig(current, uris)
+			if err != nil {
+				ss.Errorf("error updating servers from subscription: %v", err)
+				return
+			}
+			list.Set(servers, groups)
+			subServers = uris
+			ss.Infof("updated servers from subscription")
+		})
+	}
+	balancer, groupBalancers, err := config.Balancers()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	list.SetBalancers(balancer, groupBalancers)
+	if config.HealthCheckURL != "" {
+		checker, err := ss.NewHealthChecker(nil, config.HealthCheckURL)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		checker.ServerList = list
+		checker.Interval = time.Duration(config.HealthCheckInterval) * time.Second
+		checker.Fall = config.HealthCheckFall
+		go checker.Run(context.Background())
+	}
+	// the router is created even without rules, so rules can be added by
+	// reloading the config
+	router := ss.NewRouter(nil)
+	if config.GeoIPDatabase != "" {
+		if router.GeoIP, err = ss.OpenGeoIP(config.GeoIPDatabase); err != nil {
+			fmt.Fprintf(os.Stderr, "error opening %s: %v\n", config.GeoIPDatabase, err)
+			os.Exit(1)
+		}
+	}
+	router.Resolve = config.GeoIPResolve
+	var pac *ss.PACHandler
+	if config.LocalPACPort != 0 {
+		pac = &ss.PACHandler{SOCKSPort: config.LocalPort, HTTPPort: config.LocalHTTPPort}
+		if pac.HTTPPort == 0 {
+			pac.HTTPPort = config.LocalPort
+		}
+	}
+	if err = loadAll(config, groups, router, pac); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var locals []*ss.Local // guarded by mu
+	// Only the servers, their balancers, the rules, the timeouts and the
+	// logging are reloaded, established connections keep their server.
+	go waitSignal(func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		newConfig, err := readConfig(configFile, &cmdConfig, cmdServer)
+		if err != nil {
+			return err
+		}
+		servers, groups, err := parseServerConfig(newConfig, subServers)
+		if err != nil {
+			return err
+		}
+		balancer, groupBalancers, err := newConfig.Balancers()
+		if err != nil {
+			return err
+		}
+		if _, err = ss.ParseLogLevel(newConfig.LogLevel); err != nil {
+			return err
+		}
+		if _, err = ss.ParseLogFormat(newConfig.LogFormat); err != nil {
+			return err
+		}
+		// the rules are checked against the new groups before anything
+		// is replaced
+		if err = loadAll(newConfig, groups, router, pac); err != nil {
+			return err
+		}
+		list.Set(servers, groups)
+		list.SetBalancers(balancer, groupBalancers)
+		for _, local := range locals {
+			local.SetTimeouts(time.Duration(newConfig.Timeout)*time.Second,
+				time.Duration(newConfig.ConnectTimeout)*time.Second)
+		}
+		newConfig.SetupLogger(os.Stdout, bool(debug))
+		current = newConfig
+		return nil
+	})
+	newLocal := func(handler ss.InboundHandler) *ss.Local {
+		local := ss.NewLocal(nil, handler)
+		local.ServerList = list
+		local.Router = router
+		mu.Lock()
+		local.Timeout = time.Duration(current.Timeout) * time.Second
+		local.ConnectTimeout = time.Duration(current.ConnectTimeout) * time.Second
+		locals = append(locals, local)
+		mu.Unlock()
+		return local
+	}
+	serve := func(proto string, port int, handler ss.InboundHandler) {
+		go run(proto, cmdLocal+":"+strconv.Itoa(port), newLocal(handler))
+	}
 
-	run(cmdLocal + ":" + strconv.Itoa(config.LocalPort))
+	if config.LocalPort != 0 {
+		// socks5, socks4 and http are all served on the local port
+		mixed := &ss.MixedHandler{
+			SOCKS5: &ss.SOCKS5Handler{
+				Users:        config.LocalUsers,
+				AuthRequired: config.LocalAuthRequired,
+				DeferReply:   config.LocalSOCKSDeferReply,
+				ProbeTimeout: time.Duration(config.LocalSOCKSProbeTimeout) * time.Millisecond,
+			},
+			HTTP: &ss.HTTPHandler{
+				Users:        config.LocalUsers,
+				AuthRequired: config.LocalAuthRequired,
+			},
+		}
+		// socks4 has no authentication
+		if !config.LocalAuthRequired {
+			mixed.SOCKS4 = &ss.SOCKS4Handler{}
+		}
+		serve("socks5/socks4/http server", config.LocalPort, mixed)
+	}
+	if config.LocalHTTPPort != 0 {
+		serve("http proxy server", config.LocalHTTPPort, &ss.HTTPHandler{
+			Users:        config.LocalUsers,
+			AuthRequired: config.LocalAuthRequired,
+		})
+	}
+	if config.LocalRedirPort != 0 {
+		serve("transparent proxy server", config.LocalRedirPort, &ss.RedirHandler{})
+	}
+	if config.LocalTProxyPort != 0 {
+		go runTProxyUDP(cmdLocal+":"+strconv.Itoa(config.LocalTProxyPort), newLocal(nil))
+	}
+	if config.LocalDNSPort != 0 {
+		h := &ss.DNSHandler{
+			Resolvers:       config.DNSResolvers,
+			DirectResolvers: config.DNSDirectResolvers,
+			DirectDomains:   config.DNSDirectDomains,
+		}
+		if len(h.Resolvers) == 0 {
+			h.Resolvers = []string{"8.8.8.8:53"}
+		}
+		serve("tcp dns server", config.LocalDNSPort, h)
+		go runDNSUDP(cmdLocal+":"+strconv.Itoa(config.LocalDNSPort), newLocal(nil), h)
+	}
+	if pac != nil {
+		go runHTTP("pac server", cmdLocal+":"+strconv.Itoa(config.LocalPACPort), pac)
+	}
+	if config.LocalStatusPort != 0 {
+		go runHTTP("status server", cmdLocal+":"+strconv.Itoa(config.LocalStatusPort), &ss.StatusHandler{ServerList: list})
+	}
+	for _, t := range tunnels {
+		// the target is validated by ParseTunnel
+		handler, _ := ss.NewTunnelHandler(t.target)
+		go run("tcp tunnel to "+t.target, t.listen, newLocal(handler))
+		go runTunnelUDP(t.listen, t.target, newLocal(nil))
+	}
+	// run exits the program on error
+	select {}
 }
@@ -1,13 +1,9 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"log"
 	"net"
 	"os"
 	"os/signal"
@@ -16,168 +12,14 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
 )
 
-const (
-	idType  = 0 // address type index
-	idIP0   = 1 // ip addres start index
-	idDmLen = 1 // domain address length index
-	idDm0   = 2 // domain address start index
-
-	typeIPv4 = 1 // type is ipv4 address
-	typeDm   = 3 // type is domain address
-	typeIPv6 = 4 // type is ipv6 address
-
-	lenIPv4     = net.IPv4len + 2 // ipv4 + 2port
-	lenIPv6     = net.IPv6len + 2 // ipv6 + 2port
-	lenDmBase   = 2               // 1addrLen + 2port, plus addrLen
-	lenHmacSha1 = 10
-)
-
 var debug ss.DebugLog
 var udp bool
 
-func getRequest(conn *ss.Conn, auth bool) (host string, ota bool, err error) {
-	ss.SetReadTimeout(conn)
-
-	// buf size should at least have the same size with the largest possible
-	// request size (when addrType is 3, domain name has at most 256 bytes)
-	// 1(addrType) + 1(lenByte) + 255(max length address) + 2(port) + 10(hmac-sha1)
-	buf := make([]byte, 269)
-	// read till we get possible domain length field
-	if _, err = io.ReadFull(conn, buf[:idType+1]); err != nil {
-		return
-	}
-
-	var reqStart, reqEnd int
-	addrType := buf[idType]
-	switch addrType & ss.AddrMask {
-	case typeIPv4:
-		reqStart, reqEnd = idIP0, idIP0+lenIPv4
-	case typeIPv6:
-		reqStart, reqEnd = idIP0, idIP0+lenIPv6
-	case typeDm:
-		if _, err = io.ReadFull(conn, buf[idType+1:idDmLen+1]); err != nil {
-			return
-		}
-		reqStart, reqEnd = idDm0, idDm0+int(buf[idDmLen])+lenDmBase
-	default:
-		err = fmt.Errorf("addr type %d not supported", addrType&ss.AddrMask)
-		return
-	}
-
-	if _, err = io.ReadFull(conn, buf[reqStart:reqEnd]); err != nil {
-		return
-	}
-
-	// Return string for typeIP is not most efficient, but browsers (Chrome,
-	// Safari, Firefox) all seems using typeDm exclusively. So this is not a
-	// big problem.
-	switch addrType & ss.AddrMask {
-	case typeIPv4:
-		host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
-	case typeIPv6:
-		host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
-	case typeDm:
-		host = string(buf[idDm0 : idDm0+int(buf[idDmLen])])
-	}
-	// parse port
-	port := binary.BigEndian.Uint16(buf[reqEnd-2 : reqEnd])
-	host = net.JoinHostPort(host, strconv.Itoa(int(port)))
-	// if specified one time auth enabled, we should verify this
-	if auth || addrType&ss.OneTimeAuthMask > 0 {
-		ota = true
-		if _, err = io.ReadFull(conn, buf[reqEnd:reqEnd+lenHmacSha1]); err != nil {
-			return
-		}
-		iv := conn.GetIv()
-		key := conn.GetKey()
-		actualHmacSha1Buf := ss.HmacSha1(append(iv, key...), buf[:reqEnd])
-		if !bytes.Equal(buf[reqEnd:reqEnd+lenHmacSha1], actualHmacSha1Buf) {
-			err = fmt.Errorf("verify one time auth failed, iv=%v key=%v data=%v", iv, key, buf[:reqEnd])
-			return
-		}
-	}
-	return
-}
-
-const logCntDelta = 100
-
-var connCnt int
-var nextLogConnCnt int = logCntDelta
-
-func handleConnection(conn *ss.Conn, auth bool) {
-	var host string
-
-	connCnt++ // this maybe not accurate, but should be enough
-	if connCnt-nextLogConnCnt >= 0 {
-		// XXX There's no xadd in the atomic package, so it's difficult to log
-		// the message only once with low cost. Also note nextLogConnCnt maybe
-		// added twice for current peak connection number level.
-		log.Printf("Number of client connections reaches %d\n", nextLogConnCnt)
-		nextLogConnCnt += logCntDelta
-	}
-
-	// function arguments are always evaluated, so surround debug statement
-	// with if statement
-	if debug {
-		debug.Printf("new client %s->%s\n", conn.RemoteAddr().String(), conn.LocalAddr())
-	}
-	closed := false
-	defer func() {
-		if debug {
-			debug.Printf("closed pipe %s<->%s\n", conn.RemoteAddr(), host)
-		}
-		connCnt--
-		if !closed {
-			conn.Close()
-		}
-	}()
-
-	host, ota, err := getRequest(conn, auth)
-	if err != nil {
-		log.Println("error getting request", conn.RemoteAddr(), conn.LocalAddr(), err)
-		closed = true
-		return
-	}
-	// ensure the host does not contain some illegal characters, NUL may panic on Win32
-	if strings.ContainsRune(host, 0x00) {
-		log.Println("invalid domain name.")
-		closed = true
-		return
-	}
-	debug.Println("connecting", host)
-	remote, err := net.Dial("tcp", host)
-	if err != nil {
-		if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
-			// log too many open file error
-			// EMFILE is process reaches open file limits, ENFILE is system limit
-			log.Println("dial error:", err)
-		} else {
-			log.Println("error connecting to:", host, err)
-		}
-		return
-	}
-	defer func() {
-		if !closed {
-			remote.Close()
-		}
-	}()
-	if debug {
-		debug.Printf("piping %s<->%s ota=%v connOta=%v", conn.RemoteAddr(), host, ota, conn.IsOta())
-	}
-	if ota {
-		go ss.PipeThenCloseOta(conn, remote)
-	} else {
-		go ss.PipeThenClose(conn, remote)
-	}
-	ss.PipeThenClose(remote, conn)
-	closed = true
-	return
-}
-
 type PortListener struct {
 	password string
 	listener net.Listener
@@ -248,20 +90,21 @@ func (pm *PasswdManager) del(port string) {
 func (pm *PasswdManager) updatePortPasswd(port, password string, auth bool) {
 	pl, ok := pm.get(port)
 	if !ok {
-		log.Printf("new port %s added\n", port)
+		ss.Infof("new port %s added", port)
 	} else {
 		if pl.password == password {
 			return
 		}
-		log.Printf("closing port %s to update password\n", port)
+		ss.Infof("closing port %s to update password", port)
 		pl.listener.Close()
 	}
 	// run will add the new port listener to passwdManager.
 	// So there maybe concurrent access to passwdManager and we need lock to protect it.
 	go run(port, password, auth)
 	if udp {
-		pl, _ := pm.getUDP(port)
-		pl.listener.Close()
+		if pl, ok := pm.getUDP(port); ok {
+			pl.listener.Close()
+		}
 		go runUDP(port, password, auth)
 	}
 }
@@ -269,10 +112,10 @@ func (pm *PasswdManager) updatePortPasswd(port, password string, auth bool) {
 var passwdManager = PasswdManager{portListener: map[string]*PortListener{}, udpListener: map[string]*UDPListener{}}
 
 func updatePasswd() {
-	log.Println("updating password")
+	ss.Infof("updating password")
 	newconfig, err := ss.ParseConfig(configFile)
 	if err != nil {
-		log.Printf("error parsing config file %s to update password: %v\n", configFile, err)
+		ss.Errorf("error parsing config file %s to update password: %v", configFile, err)
 		return
 	}
 	oldconfig := config
@@ -289,80 +132,126 @@ func updatePasswd() {
 	}
 	// port password still left in the old config should be closed
 	for port, _ := range oldconfig.PortPassword {
-		log.Printf("closing port %s as it's deleted\n", port)
+		ss.Infof("closing port %s as it's deleted", port)
 		passwdManager.del(port)
 	}
-	log.Println("password updated")
+	ss.Infof("password updated")
+}
+
+var accessLogFile *ss.RotatingFile
+
+func openAccessLog(config *ss.Config) error {
+	const (
+		defaultMaxSize = 100 // MB
+		defaultBackups = 5
+	)
+	if config.AccessLog == "" {
+		return nil
+	}
+	maxSize := config.AccessLogMaxSize
+	if maxSize == 0 {
+		maxSize = defaultMaxSize
+	}
+	backups := config.AccessLogBackups
+	if backups == 0 {
+		backups = defaultBackups
+	}
+	f, err := ss.OpenRotatingFile(config.AccessLog, int64(maxSize)<<20, backups)
+	if err != nil {
+		return err
+	}
+	format, err := ss.ParseLogFormat(config.LogFormat)
+	if err != nil {
+		return err
+	}
+	accessLogFile = f
+	ss.SetAccessLogger(ss.NewLogger(f, ss.LevelInfo, format))
+	ss.Infof("writing access log to %s", config.AccessLog)
+	return nil
+}
+
+func reopenAccessLog() {
+	if accessLogFile == nil {
+		return
+	}
+	if err := accessLogFile.Reopen(); err != nil {
+		ss.Errorf("error reopening access log: %v", err)
+		return
+	}
+	ss.Infof("access log reopened")
 }
 
 func waitSignal() {
 	var sigChan = make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP)
+	if reopenSignal != nil {
+		signal.Notify(sigChan, reopenSignal)
+	}
 	for sig := range sigChan {
 		if sig == syscall.SIGHUP {
 			updatePasswd()
+		} else if sig == reopenSignal {
+			reopenAccessLog()
 		} else {
 			// is this going to happen?
-			log.Printf("caught signal %v, exit", sig)
+			ss.Infof("caught signal %v, exit", sig)
 			os.Exit(0)
 		}
 	}
 }
 
+func newServer(password string, auth bool) (*ss.Server, error) {
+	cipher, err := ss.NewCipher(config.Method, password)
+	if err != nil {
+		return nil, err
+	}
+	srv := ss.NewServer(cipher)
+	srv.Auth = auth
+	srv.Timeout = time.Duration(config.Timeout) * time.Second
+	return srv, nil
+}
+
 func run(port, password string, auth bool) {
 	ln, err := net.Listen("tcp", ":"+port)
 	if err != nil {
-		log.Printf("error listening port %v: %v\n", port, err)
+		ss.Errorf("error listening port %v: %v", port, err)
 		os.Exit(1)
 	}
 	passwdManager.add(port, password, ln)
-	var cipher *ss.Cipher
-	log.Printf("server listening port %v ...\n", port)
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			// listener maybe closed to update password
-			debug.Printf("accept error: %v\n", err)
-			return
-		}
-		// Creating cipher upon first connection.
-		if cipher == nil {
-			log.Println("creating cipher for port:", port)
-			cipher, err = ss.NewCipher(config.Method, password)
-			if err != nil {
-				log.Printf("Error generating cipher for port: %s %v\n", port, err)
-				conn.Close()
-				continue
-			}
-		}
-		go handleConnection(ss.NewConn(conn, cipher.Copy()), auth)
+	ss.Infof("creating cipher for port: %s", port)
+	srv, err := newServer(password, auth)
+	if err != nil {
+		ss.Errorf("Error generating cipher for port: %s %v", port, err)
+		ln.Close()
+		return
+	}
+	ss.Infof("server listening port %v ...", port)
+	// listener maybe closed to update password
+	if err = srv.Serve(ln); err != nil {
+		ss.Debugf("accept error: %v", err)
 	}
 }
 
 func runUDP(port, password string, auth bool) {
-	var cipher *ss.Cipher
 	port_i, _ := strconv.Atoi(port)
-	log.Printf("listening udp port %v\n", port)
+	ss.Infof("listening udp port %v", port)
 	conn, err := net.ListenUDP("udp", &net.UDPAddr{
 		IP:   net.IPv6zero,
 		Port: port_i,
 	})
-	passwdManager.addUDP(port, password, conn)
 	if err != nil {
-		log.Printf("error listening udp port %v: %v\n", port, err)
+		ss.Errorf("error listening udp port %v: %v", port, err)
 		return
 	}
+	passwdManager.addUDP(port, password, conn)
 	defer conn.Close()
-	cipher, err = ss.NewCipher(config.Method, password)
+	srv, err := newServer(password, auth)
 	if err != nil {
-		log.Printf("Error generating cipher for udp port: %s %v\n", port, err)
-		conn.Close()
+		ss.Errorf("Error generating cipher for udp port: %s %v", port, err)
+		return
 	}
-	SecurePacketConn := ss.NewSecurePacketConn(conn, cipher.Copy(), auth)
-	for {
-		if err := ss.ReadAndHandleUDPReq(SecurePacketConn); err != nil {
-			debug.Println(err)
-		}
+	if err = srv.ServePacket(conn); err != nil {
+		ss.Debugf("%v", err)
 	}
 }
 
@@ -390,8 +279,6 @@ var configFile string
 var config *ss.Config
 
 func main() {
-	log.SetOutput(os.Stdout)
-
 	var cmdConfig ss.Config
 	var printVer bool
 	var core int
@@ -404,7 +291,12 @@ func main() {
 	flag.StringVar(&cmdConfig.Method, "m", "", "encryption method, default: aes-256-cfb")
 	flag.IntVar(&core, "core", 0, "maximum number of CPU cores to use, default is determinied by Go runtime")
 	flag.BoolVar((*bool)(&debug), "d", false, "print debug message")
+	flag.StringVar(&cmdConfig.LogLevel, "log-level", "", "log level: error, warn, info, debug or trace, default: info")
+	flag.StringVar(&cmdConfig.LogFormat, "log-format", "", "log format: text or json, default: text")
 	flag.BoolVar(&udp, "u", false, "UDP Relay")
+	flag.StringVar(&cmdConfig.AccessLog, "access-log", "", "access log file, reopened on SIGUSR1")
+	flag.IntVar(&cmdConfig.AccessLogMaxSize, "access-log-max-size", 0, "rotate access log when it exceeds this size in MB, default: 100")
+	flag.IntVar(&cmdConfig.AccessLogBackups, "access-log-backups", 0, "number of rotated access log files to keep, default: 5")
 	flag.Parse()
 
 	if printVer {
@@ -412,8 +304,6 @@ func main() {
 		os.Exit(0)
 	}
 
-	ss.SetDebug(debug)
-
 	if strings.HasSuffix(cmdConfig.Method, "-auth") {
 		cmdConfig.Method = cmdConfig.Method[:len(cmdConfig.Method)-5]
 		cmdConfig.Auth = true
@@ -431,6 +321,14 @@ func main() {
 	} else {
 		ss.UpdateConfig(config, &cmdConfig)
 	}
+	if err = config.SetupLogger(os.Stdout, bool(debug)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = openAccessLog(config); err != nil {
+		fmt.Fprintln(os.Stderr, "error opening access log:", err)
+		os.Exit(1)
+	}
 	if config.Method == "" {
 		config.Method = "aes-256-cfb"
 	}
@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reopenSignal asks the server to reopen the access log after it has been
+// moved by logrotate.
+var reopenSignal os.Signal = syscall.SIGUSR1
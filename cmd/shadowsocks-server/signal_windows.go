@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// There's no SIGUSR1 on windows, access log can't be reopened.
+var reopenSignal os.Signal
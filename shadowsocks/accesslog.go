@@ -0,0 +1,210 @@
+package shadowsocks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CloseReason tells why a relayed connection or UDP session ended.
+type CloseReason string
+
+const (
+	CloseEOF          CloseReason = "eof"
+	CloseTimeout      CloseReason = "timeout"
+	CloseOTAFailure   CloseReason = "ota_failure"
+	CloseDialError    CloseReason = "dial_error"
+	CloseRequestError CloseReason = "request_error"
+	CloseRejected     CloseReason = "rejected"
+	CloseError        CloseReason = "error"
+)
+
+var ErrOTAFailed = errors.New("shadowsocks: one time auth verification failed")
+
+// isClosedConnError reports whether err is caused by reading from a
+// connection closed by the other pipe direction. There's no easy way to
+// identify this error, refer to https://code.google.com/p/go/issues/detail?id=4373
+func isClosedConnError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// CloseReasonOf classifies the errors returned by the pipes of a connection.
+// OTA failure is reported in preference to timeout, and timeout in
+// preference to other errors. Errors caused by the connection being closed
+// locally count as EOF.
+func CloseReasonOf(errs ...error) CloseReason {
+	reason := CloseEOF
+	for _, err := range errs {
+		if err == nil || err == io.EOF || isClosedConnError(err) {
+			continue
+		}
+		if err == ErrOTAFailed {
+			return CloseOTAFailure
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			reason = CloseTimeout
+		} else if reason == CloseEOF {
+			reason = CloseError
+		}
+	}
+	return reason
+}
+
+// AccessEntry records one relayed TCP connection or UDP NAT session.
+type AccessEntry struct {
+	ConnID    uint64
+	Network   string // "tcp" or "udp"
+	Client    string
+	Port      string // listening port
+	User      string
+	Target    string
+	OTA       bool
+	BytesUp   int64 // client to target
+	BytesDown int64 // target to client
+	Start     time.Time
+	Reason    CloseReason
+}
+
+var (
+	accessLoggerMu sync.RWMutex
+	accessLogger   Logger
+)
+
+// SetAccessLogger sets the logger receiving access log entries. Access log is
+// disabled if l is nil, which is the default.
+func SetAccessLogger(l Logger) {
+	accessLoggerMu.Lock()
+	accessLogger = l
+	accessLoggerMu.Unlock()
+}
+
+// LogAccess writes e to the access logger, if any.
+func LogAccess(e *AccessEntry) {
+	accessLoggerMu.RLock()
+	l := accessLogger
+	accessLoggerMu.RUnlock()
+	logAccess(l, e)
+}
+
+func logAccess(l Logger, e *AccessEntry) {
+	if l == nil {
+		return
+	}
+	l.Log(LevelInfo, "access",
+		F(KeyConnID, e.ConnID),
+		F("network", e.Network),
+		F(KeyClient, e.Client),
+		F(KeyPort, e.Port),
+		F(KeyUser, e.User),
+		F(KeyTarget, e.Target),
+		F("bytes_up", e.BytesUp),
+		F("bytes_down", e.BytesDown),
+		F(KeyDuration, time.Since(e.Start)),
+		F("reason", string(e.Reason)))
+}
+
+var errFileClosed = errors.New("shadowsocks: file already closed")
+
+// RotatingFile is an io.Writer appending to a file, which is rotated when it
+// grows beyond a size limit. Rotated files are named path.1, path.2 and so on,
+// path.1 being the most recent one.
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens path for appending. The file is rotated when its
+// size would exceed maxSize bytes, 0 means never. At most maxBackups rotated
+// files are kept.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = stat.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (n int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, errFileClosed
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		// p is still written to the reopened file if the rotation failed
+		if err = r.rotate(); r.f == nil {
+			return
+		}
+	}
+	n, err = r.f.Write(p)
+	r.size += int64(n)
+	return
+}
+
+// rotate moves the file to path.1, or removes it if no backup is kept, then
+// opens path again. The file is opened again even if it can't be moved, for
+// example if moved by external tools, so that later writes don't fail.
+func (r *RotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	var err error
+	if r.maxBackups > 0 {
+		for i := r.maxBackups - 1; i > 0; i-- {
+			os.Rename(r.path+"."+strconv.Itoa(i), r.path+"."+strconv.Itoa(i+1))
+		}
+		err = os.Rename(r.path, r.path+".1")
+	} else {
+		err = os.Remove(r.path)
+	}
+	if oerr := r.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+// Reopen closes and opens the file again. Use it after the file has been
+// moved by external tools such as logrotate.
+func (r *RotatingFile) Reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
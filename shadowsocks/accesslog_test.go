@@ -0,0 +1,102 @@
+package shadowsocks
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestCloseReasonOf(t *testing.T) {
+	closedErr := errors.New("read tcp 127.0.0.1:8388: use of closed network connection")
+	tests := []struct {
+		errs   []error
+		reason CloseReason
+	}{
+		{[]error{nil, io.EOF}, CloseEOF},
+		{[]error{io.EOF, closedErr}, CloseEOF},
+		{[]error{closedErr, timeoutError{}}, CloseTimeout},
+		{[]error{timeoutError{}, ErrOTAFailed}, CloseOTAFailure},
+		{[]error{errors.New("connection reset by peer"), io.EOF}, CloseError},
+	}
+	for _, tt := range tests {
+		if r := CloseReasonOf(tt.errs...); r != tt.reason {
+			t.Errorf("CloseReasonOf(%v) = %s, want %s", tt.errs, r, tt.reason)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ss-accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for p, content := range expect {
+		data, err := ioutil.ReadFile(p)
+		if err != nil || string(data) != content {
+			t.Errorf("%s: got %q %v, want %q", p, data, err, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("should keep at most 2 backups")
+	}
+
+	// simulate logrotate moving the file away
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("fifth\n"))
+	if data, _ := ioutil.ReadFile(path); string(data) != "fifth\n" {
+		t.Errorf("reopened file content %q", data)
+	}
+
+	// a failed rotation drops neither the entry nor the later ones
+	os.Remove(path)
+	if _, err := f.Write([]byte("sixth\n")); err != nil {
+		t.Errorf("write with a failed rotation: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "sixth\n" {
+		t.Errorf("content after a failed rotation %q", data)
+	}
+	if _, err := f.Write([]byte("seventh\n")); err != nil {
+		t.Errorf("write after a failed rotation: %v", err)
+	}
+	f.Close()
+	if data, _ := ioutil.ReadFile(path); string(data) != "seventh\n" {
+		t.Errorf("content after the next rotation %q", data)
+	}
+	if data, _ := ioutil.ReadFile(path + ".1"); string(data) != "sixth\n" {
+		t.Errorf("backup after the next rotation %q", data)
+	}
+	if _, err := f.Write([]byte("eighth\n")); err != errFileClosed {
+		t.Errorf("write after close: %v", err)
+	}
+}
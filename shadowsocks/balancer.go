@@ -0,0 +1,218 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancer chooses the order in which the servers are tried for a connection
+// to addr, a host:port address. The returned slice must not be servers
+// itself if reordered, as it's shared. Whatever the order, servers whose
+// circuit breaker is open are skipped, see Local.Connect.
+// Implementations must be safe for concurrent use.
+type Balancer interface {
+	Pick(servers []*Upstream, addr string) []*Upstream
+}
+
+// BalancerFunc allows using ordinary functions as Balancer.
+type BalancerFunc func(servers []*Upstream, addr string) []*Upstream
+
+func (f BalancerFunc) Pick(servers []*Upstream, addr string) []*Upstream {
+	return f(servers, addr)
+}
+
+// NewBalancer returns the balancer named:
+//
+//	failover     servers in order, the default
+//	round-robin  each connection starts with the next server
+//	weighted     random order, each server is chosen first proportionally to
+//	             its weight
+//	least-conn   servers with the fewest active connections first
+//	latency      servers with the lowest connection latency first
+//	hash         the order depends on the target host, so that a site always
+//	             sees the same server while it's up
+func NewBalancer(name string) (Balancer, error) {
+	switch name {
+	case "", "failover":
+		return BalancerFunc(failover), nil
+	case "round-robin":
+		return &roundRobin{}, nil
+	case "weighted":
+		return BalancerFunc(weighted), nil
+	case "least-conn":
+		return BalancerFunc(leastConn), nil
+	case "latency":
+		return BalancerFunc(lowestLatency), nil
+	case "hash":
+		return &hashBalancer{rings: make(map[string][]hashPoint)}, nil
+	}
+	return nil, fmt.Errorf("unknown balancer %s", name)
+}
+
+func failover(servers []*Upstream, addr string) []*Upstream {
+	return servers
+}
+
+type roundRobin struct {
+	next uint32 // accessed atomically
+}
+
+func (b *roundRobin) Pick(servers []*Upstream, addr string) []*Upstream {
+	if len(servers) < 2 {
+		return servers
+	}
+	i := int((atomic.AddUint32(&b.next, 1) - 1) % uint32(len(servers)))
+	order := make([]*Upstream, 0, len(servers))
+	order = append(order, servers[i:]...)
+	return append(order, servers[:i]...)
+}
+
+// byKey sorts servers by increasing key.
+type byKey struct {
+	servers []*Upstream
+	key     []float64
+}
+
+func (s byKey) Len() int           { return len(s.servers) }
+func (s byKey) Less(i, j int) bool { return s.key[i] < s.key[j] }
+func (s byKey) Swap(i, j int) {
+	s.servers[i], s.servers[j] = s.servers[j], s.servers[i]
+	s.key[i], s.key[j] = s.key[j], s.key[i]
+}
+
+// sortServers returns servers sorted by key, keeping the order of servers
+// with the same key.
+func sortServers(servers []*Upstream, key func(se *Upstream) float64) []*Upstream {
+	s := byKey{
+		servers: append([]*Upstream(nil), servers...),
+		key:     make([]float64, len(servers)),
+	}
+	for i, se := range s.servers {
+		s.key[i] = key(se)
+	}
+	sort.Stable(s)
+	return s.servers
+}
+
+// weightedRand is the source of the weighted balancer, seeded here rather
+// than reseeding the global source of the programs using this package.
+var (
+	weightedRandMu sync.Mutex
+	weightedRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func weighted(servers []*Upstream, addr string) []*Upstream {
+	weightedRandMu.Lock()
+	defer weightedRandMu.Unlock()
+	// Efraimidis and Spirakis weighted random sampling: sorting by
+	// -u^(1/weight), with u uniform in [0, 1).
+	return sortServers(servers, func(se *Upstream) float64 {
+		return -math.Pow(weightedRand.Float64(), 1/float64(se.weight()))
+	})
+}
+
+func leastConn(servers []*Upstream, addr string) []*Upstream {
+	return sortServers(servers, func(se *Upstream) float64 {
+		return float64(se.Active())
+	})
+}
+
+// lowestLatency tries servers without latency measured first, so they get
+// measured.
+func lowestLatency(servers []*Upstream, addr string) []*Upstream {
+	return sortServers(servers, func(se *Upstream) float64 {
+		return float64(se.Latency())
+	})
+}
+
+// hashVirtualNodes is the number of points of a server of weight 1 on the
+// ring of hashBalancer.
+const hashVirtualNodes = 100
+
+type hashPoint struct {
+	hash uint32
+	se   *Upstream
+}
+
+type byHash []hashPoint
+
+func (r byHash) Len() int           { return len(r) }
+func (r byHash) Less(i, j int) bool { return r[i].hash < r[j].hash }
+func (r byHash) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// hashBalancer orders servers by their position on a consistent hash ring
+// after the target host, so that only the hosts of a failed or removed
+// server move to other servers.
+type hashBalancer struct {
+	mu    sync.Mutex
+	rings map[string][]hashPoint // by server list
+}
+
+// maxHashRings limits the rings cached by hashBalancer, as server lists
+// change when replaced by a ServerList.
+const maxHashRings = 64
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func (b *hashBalancer) ring(servers []*Upstream) []hashPoint {
+	// servers are identified by pointer too, as the same address may be
+	// another Upstream after the servers are replaced
+	names := make([]string, len(servers))
+	for i, se := range servers {
+		names[i] = fmt.Sprintf("%s@%p", se.Server, se)
+	}
+	key := strings.Join(names, " ")
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ring, ok := b.rings[key]; ok {
+		return ring
+	}
+	if len(b.rings) >= maxHashRings {
+		b.rings = make(map[string][]hashPoint)
+	}
+	var ring []hashPoint
+	for _, se := range servers {
+		for i := 0; i < hashVirtualNodes*se.weight(); i++ {
+			ring = append(ring, hashPoint{hashString(se.Server + "#" + strconv.Itoa(i)), se})
+		}
+	}
+	sort.Sort(byHash(ring))
+	b.rings[key] = ring
+	return ring
+}
+
+func (b *hashBalancer) Pick(servers []*Upstream, addr string) []*Upstream {
+	if len(servers) < 2 {
+		return servers
+	}
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	h := hashString(strings.ToLower(host))
+	ring := b.ring(servers)
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	order := make([]*Upstream, 0, len(servers))
+	seen := make(map[*Upstream]bool, len(servers))
+	for i := 0; i < len(ring) && len(order) < len(servers); i++ {
+		p := ring[(start+i)%len(ring)]
+		if !seen[p.se] {
+			seen[p.se] = true
+			order = append(order, p.se)
+		}
+	}
+	return order
+}
@@ -0,0 +1,154 @@
+package shadowsocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func testUpstreams(n int) []*Upstream {
+	servers := make([]*Upstream, n)
+	for i := range servers {
+		servers[i] = &Upstream{Server: fmt.Sprintf("192.0.2.%d:8388", i+1)}
+	}
+	return servers
+}
+
+func serverNames(servers []*Upstream) string {
+	s := ""
+	for _, se := range servers {
+		s += se.Server[len("192.0.2.") : len(se.Server)-len(":8388")]
+	}
+	return s
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, name := range []string{"", "failover", "round-robin", "weighted", "least-conn", "latency", "hash"} {
+		if _, err := NewBalancer(name); err != nil {
+			t.Errorf("NewBalancer(%q) error %v", name, err)
+		}
+	}
+	if _, err := NewBalancer("fastest"); err == nil {
+		t.Error("unknown balancer accepted")
+	}
+}
+
+func TestBalancerOrder(t *testing.T) {
+	servers := testUpstreams(3)
+	servers[0].active, servers[1].active, servers[2].active = 2, 0, 1
+	servers[0].latency, servers[1].latency, servers[2].latency = 30, 10, 0
+	tests := []struct {
+		name  string
+		picks []string
+	}{
+		{"failover", []string{"123", "123"}},
+		{"round-robin", []string{"123", "231", "312", "123"}},
+		{"least-conn", []string{"231"}},
+		{"latency", []string{"321"}},
+	}
+	for _, tt := range tests {
+		b, _ := NewBalancer(tt.name)
+		for i, want := range tt.picks {
+			if got := serverNames(b.Pick(servers, "example.com:443")); got != want {
+				t.Errorf("%s pick %d is %s, want %s", tt.name, i, got, want)
+			}
+		}
+	}
+	if serverNames(servers) != "123" {
+		t.Errorf("servers reordered to %s", serverNames(servers))
+	}
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	servers := testUpstreams(3)
+	servers[0].Weight, servers[1].Weight = 8, 2 // the third one is 1
+	b, _ := NewBalancer("weighted")
+	first := make(map[*Upstream]int)
+	const n = 10000
+	for i := 0; i < n; i++ {
+		order := b.Pick(servers, "example.com:443")
+		if len(order) != 3 {
+			t.Fatalf("pick returned %d servers", len(order))
+		}
+		first[order[0]]++
+	}
+	for i, want := range []float64{8.0 / 11, 2.0 / 11, 1.0 / 11} {
+		if got := float64(first[servers[i]]) / n; got < want-0.03 || got > want+0.03 {
+			t.Errorf("server %d is first %.2f of the time, want %.2f", i, got, want)
+		}
+	}
+}
+
+func TestHashBalancer(t *testing.T) {
+	servers := testUpstreams(4)
+	b, _ := NewBalancer("hash")
+	firsts := make(map[string]*Upstream)
+	used := make(map[*Upstream]bool)
+	for i := 0; i < 200; i++ {
+		host := fmt.Sprintf("site%d.example", i)
+		order := b.Pick(servers, host+":443")
+		if len(order) != 4 {
+			t.Fatalf("pick returned %d servers", len(order))
+		}
+		if again := b.Pick(servers, host+":80"); serverNames(again) != serverNames(order) {
+			t.Errorf("%s got orders %s and %s", host, serverNames(order), serverNames(again))
+		}
+		firsts[host] = order[0]
+		used[order[0]] = true
+	}
+	if len(used) != 4 {
+		t.Errorf("only %d servers used", len(used))
+	}
+
+	// only the sites of the removed server move
+	for host, se := range firsts {
+		order := b.Pick(servers[1:], host+":443")
+		if se != servers[0] && order[0] != se {
+			t.Errorf("%s moved from %s to %s", host, se.Server, order[0].Server)
+		}
+	}
+}
+
+func TestLocalBalancer(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	srv1, addr1 := startServer(t, cipher)
+	defer srv1.Close()
+	srv2, addr2 := startServer(t, cipher)
+	defer srv2.Close()
+
+	se1, se2 := &Upstream{Server: addr1, Cipher: cipher}, &Upstream{Server: addr2, Cipher: cipher}
+	l := NewLocal([]*Upstream{se1, se2}, nil)
+	l.Balancer, _ = NewBalancer("least-conn")
+	target := echo.Addr().String()
+	rawaddr, _ := RawAddr(target)
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := l.Connect(context.Background(), rawaddr, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		checkEcho(t, c)
+		conns = append(conns, c)
+	}
+	if se1.Active() != 2 || se2.Active() != 1 {
+		t.Errorf("active connections %d and %d, want 2 and 1", se1.Active(), se2.Active())
+	}
+	if se1.Latency() <= 0 || se2.Latency() <= 0 {
+		t.Errorf("latencies %v and %v not measured", se1.Latency(), se2.Latency())
+	}
+	for _, c := range conns {
+		c.Close()
+		c.Close()
+	}
+	if se1.Active() != 0 || se2.Active() != 0 {
+		t.Errorf("active connections %d and %d after closing", se1.Active(), se2.Active())
+	}
+}
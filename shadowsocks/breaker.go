@@ -0,0 +1,113 @@
+package shadowsocks
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	breakerMinBackoff = time.Second
+	breakerMaxBackoff = 5 * time.Minute
+)
+
+// BreakerState is the state of the circuit breaker of a server.
+type BreakerState int32
+
+const (
+	// BreakerClosed lets all connections try the server.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen skips the server until the backoff delay elapses.
+	BreakerOpen
+	// BreakerHalfOpen lets a single connection try the server, whose
+	// result closes or opens the circuit again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// breaker is the circuit breaker of a server. A connection failure opens the
+// circuit, then the server is skipped for a backoff delay, after which the
+// circuit is half-open. A success closes it, while a failure opens it again
+// with twice the delay, up to breakerMaxBackoff. Connections canceled by the
+// caller count as neither. The zero value is closed, and it's safe for
+// concurrent use without locking.
+type breaker struct {
+	retryAt  int64 // in unix nanoseconds, first for 64-bit alignment
+	state    int32
+	failures int32 // consecutive
+	opens    int32 // consecutive, setting the backoff delay
+}
+
+// breakerBackoff returns the delay before retrying a server after opens
+// openings of its circuit.
+func breakerBackoff(opens int32) time.Duration {
+	d := breakerMinBackoff
+	for i := int32(0); i < opens && d < breakerMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > breakerMaxBackoff {
+		d = breakerMaxBackoff
+	}
+	return d
+}
+
+func (b *breaker) State() BreakerState {
+	return BreakerState(atomic.LoadInt32(&b.state))
+}
+
+func (b *breaker) Failures() int {
+	return int(atomic.LoadInt32(&b.failures))
+}
+
+// allow reports whether the server may be tried at now. When the backoff
+// delay has elapsed, only the first caller is allowed, and the circuit is
+// half-open until it reports the result with success or failure.
+func (b *breaker) allow(now time.Time) bool {
+	switch b.State() {
+	case BreakerClosed:
+		return true
+	case BreakerOpen:
+		if now.UnixNano() < atomic.LoadInt64(&b.retryAt) {
+			return false
+		}
+		return atomic.CompareAndSwapInt32(&b.state, int32(BreakerOpen), int32(BreakerHalfOpen))
+	}
+	return false
+}
+
+func (b *breaker) success() {
+	atomic.StoreInt32(&b.failures, 0)
+	atomic.StoreInt32(&b.opens, 0)
+	atomic.StoreInt32(&b.state, int32(BreakerClosed))
+}
+
+func (b *breaker) failure(now time.Time) {
+	atomic.AddInt32(&b.failures, 1)
+	state := atomic.LoadInt32(&b.state)
+	if state == int32(BreakerOpen) {
+		// concurrent failures, or a server tried as a last resort
+		return
+	}
+	// retryAt is set first, as allow trusts it once the circuit is open
+	atomic.StoreInt64(&b.retryAt, now.Add(breakerBackoff(atomic.LoadInt32(&b.opens))).UnixNano())
+	if atomic.CompareAndSwapInt32(&b.state, state, int32(BreakerOpen)) {
+		atomic.AddInt32(&b.opens, 1)
+	}
+}
+
+// canceled reports a try aborted by the caller, which says nothing about the
+// server. A half-open circuit lets the next connection try again, without
+// increasing the backoff delay.
+func (b *breaker) canceled() {
+	atomic.CompareAndSwapInt32(&b.state, int32(BreakerHalfOpen), int32(BreakerOpen))
+}
@@ -0,0 +1,171 @@
+package shadowsocks
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerBackoff(t *testing.T) {
+	tests := []struct {
+		opens int32
+		d     time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{4, 16 * time.Second},
+		{8, 256 * time.Second},
+		{9, breakerMaxBackoff},
+		{100, breakerMaxBackoff},
+	}
+	for _, tt := range tests {
+		if d := breakerBackoff(tt.opens); d != tt.d {
+			t.Errorf("breakerBackoff(%d) = %v, want %v", tt.opens, d, tt.d)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	var b breaker
+	t0 := time.Unix(1000, 0)
+	check := func(step string, state BreakerState, failures int) {
+		if b.State() != state || b.Failures() != failures {
+			t.Errorf("%s: breaker %v with %d failures, want %v with %d",
+				step, b.State(), b.Failures(), state, failures)
+		}
+	}
+	if !b.allow(t0) {
+		t.Error("closed breaker doesn't allow")
+	}
+
+	b.failure(t0)
+	check("first failure", BreakerOpen, 1)
+	if b.allow(t0.Add(999 * time.Millisecond)) {
+		t.Error("allowed before the backoff delay")
+	}
+	if !b.allow(t0.Add(time.Second)) {
+		t.Error("not allowed after the backoff delay")
+	}
+	check("retry", BreakerHalfOpen, 1)
+	if b.allow(t0.Add(time.Second)) {
+		t.Error("second connection allowed while half-open")
+	}
+
+	// the delay doubles
+	t1 := t0.Add(time.Second)
+	b.failure(t1)
+	check("failed retry", BreakerOpen, 2)
+	if b.allow(t1.Add(1999 * time.Millisecond)) {
+		t.Error("allowed before the doubled backoff delay")
+	}
+	if !b.allow(t1.Add(2 * time.Second)) {
+		t.Error("not allowed after the doubled backoff delay")
+	}
+	b.success()
+	check("successful retry", BreakerClosed, 0)
+
+	// and is reset by a success
+	b.failure(t1)
+	b.failure(t1)
+	check("concurrent failures", BreakerOpen, 2)
+	if !b.allow(t1.Add(time.Second)) {
+		t.Error("not allowed after the backoff delay following a success")
+	}
+}
+
+func TestBreakerHalfOpenConcurrent(t *testing.T) {
+	var b breaker
+	now := time.Now()
+	b.failure(now)
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.allow(now.Add(time.Minute)) {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 1 {
+		t.Errorf("%d connections allowed while half-open, want 1", allowed)
+	}
+}
+
+func TestBreakerCanceled(t *testing.T) {
+	var b breaker
+	t0 := time.Unix(1000, 0)
+	b.failure(t0)
+	if !b.allow(t0.Add(time.Second)) {
+		t.Fatal("not allowed after the backoff delay")
+	}
+	b.canceled()
+	if b.State() != BreakerOpen || b.Failures() != 1 {
+		t.Errorf("breaker %v with %d failures after a canceled retry, want open with 1", b.State(), b.Failures())
+	}
+	// the next connection retries at once, and the delay isn't doubled
+	if !b.allow(t0.Add(time.Second)) {
+		t.Error("not allowed again after a canceled retry")
+	}
+	t1 := t0.Add(time.Second)
+	b.failure(t1)
+	if b.allow(t1.Add(1999 * time.Millisecond)) {
+		t.Error("allowed before the backoff delay")
+	}
+	if !b.allow(t1.Add(2 * time.Second)) {
+		t.Error("not allowed after the backoff delay, doubled once")
+	}
+
+	// canceling doesn't change a closed circuit
+	var c breaker
+	c.canceled()
+	if c.State() != BreakerClosed {
+		t.Errorf("closed breaker %v after canceled", c.State())
+	}
+}
+
+func TestLocalConnectCanceled(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+	se := &Upstream{Server: srvAddr, Cipher: cipher}
+	l := NewLocal([]*Upstream{se}, nil)
+	rawaddr, err := RawAddr("127.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err = l.connectToServer(ctx, se, rawaddr, "127.0.0.1:80"); err == nil {
+		t.Fatal("connected with a canceled context")
+	}
+	if se.Breaker() != BreakerClosed || se.Failures() != 0 {
+		t.Errorf("breaker %v with %d failures after a canceled connection", se.Breaker(), se.Failures())
+	}
+
+	// a canceled half-open retry leaves the retry to the next connection
+	se.breaker.failure(time.Now().Add(-time.Minute))
+	if !se.breaker.allow(time.Now()) {
+		t.Fatal("not allowed after the backoff delay")
+	}
+	l.connectToServer(ctx, se, rawaddr, "127.0.0.1:80")
+	if se.Breaker() != BreakerOpen || se.Failures() != 1 {
+		t.Errorf("breaker %v with %d failures after a canceled retry", se.Breaker(), se.Failures())
+	}
+	c, err := l.connectToServer(context.Background(), se, rawaddr, "127.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if se.Breaker() != BreakerClosed {
+		t.Errorf("breaker %v after a successful retry", se.Breaker())
+	}
+}
@@ -10,10 +10,13 @@ package shadowsocks
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	// "log"
+	"net"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -25,16 +28,114 @@ type Config struct {
 	Password   string      `json:"password"`
 	Method     string      `json:"method"` // encryption method
 	Auth       bool        `json:"auth"`   // one time auth
+	LogLevel   string      `json:"log_level"`
+	LogFormat  string      `json:"log_format"` // text or json
 
 	// following options are only used by server
 	PortPassword map[string]string `json:"port_password"`
 	Timeout      int               `json:"timeout"`
 
+	AccessLog        string `json:"access_log"`          // access log file path
+	AccessLogMaxSize int    `json:"access_log_max_size"` // in MB, rotate when exceeded
+	AccessLogBackups int    `json:"access_log_backups"`  // number of rotated files to keep
+
 	// following options are only used by client
 
 	// The order of servers in the client config is significant, so use array
 	// instead of map to preserve the order.
 	ServerPassword [][]string `json:"server_password"`
+	// Servers as ss:// URIs, see ParseURI, tried after those of
+	// server_password.
+	ServerURIs []string `json:"server_uris"`
+	// URL of an online server list in the SIP008 format, fetched at start
+	// and every subscription_interval seconds, default to 3600. Its
+	// servers are tried after the others. A copy of the list is kept in
+	// the subscription_cache file if given, used if the list can't be
+	// fetched at start.
+	SubscriptionURL      string `json:"subscription_url"`
+	SubscriptionInterval int    `json:"subscription_interval"`
+	SubscriptionCache    string `json:"subscription_cache"`
+
+	// Timeout in seconds for connecting to a server, 0 means no timeout.
+	ConnectTimeout int `json:"connect_timeout"`
+
+	// Balancer choosing the order of the servers for each connection, see
+	// NewBalancer for the names, default to failover.
+	Balance string `json:"balance"`
+	// Balancers of the server groups by name, balance is used for the
+	// others.
+	GroupBalance map[string]string `json:"group_balance"`
+	// Weights of the servers by address, for the weighted and hash
+	// balancers. Default to 1.
+	ServerWeights map[string]int `json:"server_weights"`
+
+	// http URL fetched through each server every health_check_interval
+	// seconds, default to 30. Servers failing health_check_fall probes in a
+	// row, default to 3, are tried last until a probe succeeds. Empty
+	// disables health checks.
+	HealthCheckURL      string `json:"health_check_url"`
+	HealthCheckInterval int    `json:"health_check_interval"`
+	HealthCheckFall     int    `json:"health_check_fall"`
+	// Port serving the state of the servers as JSON, 0 disables it.
+	LocalStatusPort int `json:"local_status_port"`
+
+	// Username and password pairs for socks5 authentication (RFC 1929) and
+	// http proxy Basic authentication.
+	LocalUsers map[string]string `json:"local_users"`
+	// Reject clients that don't authenticate with local_users.
+	LocalAuthRequired bool `json:"local_auth_required"`
+	// Reply to socks5 CONNECT requests once connected, with an error code
+	// on failure, instead of replying success at once.
+	LocalSOCKSDeferReply bool `json:"local_socks_defer_reply"`
+	// Milliseconds to wait with local_socks_defer_reply after connecting
+	// through a server, to reply host unreachable if the server closes the
+	// connection, 0 disables it.
+	LocalSOCKSProbeTimeout int `json:"local_socks_probe_timeout"`
+
+	// Port of the local http proxy, 0 disables it.
+	LocalHTTPPort int `json:"local_http_port"`
+	// Port accepting connections redirected by iptables REDIRECT, 0
+	// disables it. Only supported on linux.
+	LocalRedirPort int `json:"local_redir_port"`
+	// Port receiving UDP packets redirected by iptables TPROXY, 0 disables
+	// it. Only supported on linux.
+	LocalTProxyPort int `json:"local_tproxy_port"`
+	// Ports forwarded to fixed targets, for both TCP and UDP, in the form
+	// [listen_host:]listen_port=target_host:target_port.
+	Tunnels []string `json:"tunnels"`
+
+	// Port answering DNS queries over UDP and TCP, 0 disables it. Queries
+	// are forwarded to dns_resolvers through the server, default to
+	// 8.8.8.8, except for dns_direct_domains, which are resolved by
+	// dns_direct_resolvers.
+	LocalDNSPort       int      `json:"local_dns_port"`
+	DNSResolvers       []string `json:"dns_resolvers"`
+	DNSDirectResolvers []string `json:"dns_direct_resolvers"`
+	DNSDirectDomains   []string `json:"dns_direct_domains"`
+
+	// Path of the routing rule file, see ParseRules for the syntax.
+	Rules string `json:"rules"`
+	// Server groups used by the routing rules, mapping group names to
+	// server addresses given in server_password.
+	ServerGroups map[string][]string `json:"server_groups"`
+	// Path of the MaxMind database (.mmdb) used by GEOIP rules.
+	GeoIPDatabase string `json:"geoip_database"`
+	// Resolve domain names locally for GEOIP rules, which match only IP
+	// addresses otherwise.
+	GeoIPResolve bool `json:"geoip_resolve"`
+
+	// Port serving the proxy auto-config file made of the domains of
+	// pac_direct_domains and pac_proxy_domains, gfwlist, the routing rules
+	// and pac_default, in this order. 0 disables it.
+	LocalPACPort int `json:"local_pac_port"`
+	// Paths of domain lists, one per line, only used by the PAC file.
+	PACDirectDomains string `json:"pac_direct_domains"`
+	PACProxyDomains  string `json:"pac_proxy_domains"`
+	// Path of a gfwlist file, only used by the PAC file.
+	GFWList string `json:"gfwlist"`
+	// What the PAC file does with hosts matching nothing: proxy or direct,
+	// default to proxy.
+	PACDefault string `json:"pac_default"`
 }
 
 var readTimeout time.Duration
@@ -94,8 +195,36 @@ func ParseConfig(path string) (config *Config, err error) {
 	return
 }
 
+// SetupLogger installs the package logger according to the log_level and
+// log_format options. Debug messages are enabled if debug is true, whatever
+// log_level says.
+func (config *Config) SetupLogger(w io.Writer, debug bool) error {
+	level, err := ParseLogLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+	format, err := ParseLogFormat(config.LogFormat)
+	if err != nil {
+		return err
+	}
+	if debug && level < LevelDebug {
+		level = LevelDebug
+	}
+	SetLogger(NewLogger(w, level, format))
+	SetDebug(DebugLog(debug))
+	return nil
+}
+
+// SetDebug turns on debug messages. If the default logger is in use, its level
+// is raised to LevelDebug.
 func SetDebug(d DebugLog) {
 	Debug = d
+	if !d {
+		return
+	}
+	if l, ok := GetLogger().(*stdLogger); ok && l.level < LevelDebug {
+		SetLogger(NewLogger(l.w, LevelDebug, l.format))
+	}
 }
 
 // Useful for command line to override options specified in config file
@@ -128,9 +257,162 @@ func UpdateConfig(old, new *Config) {
 			if i != 0 {
 				oldField.SetInt(i)
 			}
+		case reflect.Slice:
+			if newField.Len() != 0 {
+				oldField.Set(reflect.AppendSlice(oldField, newField))
+			}
 		}
 	}
 
 	old.Timeout = new.Timeout
 	readTimeout = time.Duration(old.Timeout) * time.Second
 }
+
+// serverList returns the servers of the server_password and server_uris
+// options followed by extra, in the form of server_password.
+func (config *Config) serverList(extra []*ServerURI) ([][]string, error) {
+	servers := append([][]string(nil), config.ServerPassword...)
+	uris := make([]*ServerURI, 0, len(config.ServerURIs)+len(extra))
+	for i, s := range config.ServerURIs {
+		u, err := ParseURI(s)
+		if err != nil {
+			return nil, fmt.Errorf("server_uris: URI %d: %v", i+1, err)
+		}
+		uris = append(uris, u)
+	}
+	for _, u := range append(uris, extra...) {
+		if u.Plugin != "" {
+			return nil, fmt.Errorf("server %s: plugins are not supported", u.Server)
+		}
+		servers = append(servers, []string{u.Server, u.Password, u.Method})
+	}
+	return servers, nil
+}
+
+// Upstreams returns the shadowsocks servers used by the client, in the order
+// specified by the server_password and server_uris options followed by
+// extra, such as the servers of a Subscription, or by the server option if
+// there's none.
+func (config *Config) Upstreams(extra ...*ServerURI) ([]*Upstream, error) {
+	hasPort := func(s string) bool {
+		_, port, err := net.SplitHostPort(s)
+		if err != nil {
+			return false
+		}
+		return port != ""
+	}
+
+	servers, err := config.serverList(extra)
+	if err != nil {
+		return nil, err
+	}
+	var upstreams []*Upstream
+	if len(servers) == 0 {
+		method := config.Method
+		if config.Auth {
+			method += "-auth"
+		}
+		// only one encryption table
+		cipher, err := NewCipher(method, config.Password)
+		if err != nil {
+			return nil, err
+		}
+		srvPort := strconv.Itoa(config.ServerPort)
+		for _, s := range config.GetServerArray() {
+			if hasPort(s) {
+				Warnf("ignore server_port option for server %s", s)
+				upstreams = append(upstreams, &Upstream{Server: s, Cipher: cipher})
+			} else {
+				upstreams = append(upstreams, &Upstream{Server: net.JoinHostPort(s, srvPort), Cipher: cipher})
+			}
+		}
+		return upstreams, nil
+	}
+
+	// multiple servers
+	for s, w := range config.ServerWeights {
+		found := false
+		for _, serverInfo := range servers {
+			if len(serverInfo) > 0 && serverInfo[0] == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("server_weights: server %s not in server_password or server_uris", s)
+		}
+		if w < 0 {
+			return nil, fmt.Errorf("server_weights: negative weight for server %s", s)
+		}
+	}
+	cipherCache := make(map[string]*Cipher)
+	for _, serverInfo := range servers {
+		if len(serverInfo) < 2 || len(serverInfo) > 3 {
+			return nil, fmt.Errorf("server %v syntax error", serverInfo)
+		}
+		server := serverInfo[0]
+		passwd := serverInfo[1]
+		encmethod := ""
+		if len(serverInfo) == 3 {
+			encmethod = serverInfo[2]
+		}
+		if !hasPort(server) {
+			return nil, fmt.Errorf("no port for server %s", server)
+		}
+		// Using "|" as delimiter is safe here, since no encryption
+		// method contains it in the name.
+		cacheKey := encmethod + "|" + passwd
+		cipher, ok := cipherCache[cacheKey]
+		if !ok {
+			var err error
+			cipher, err = NewCipher(encmethod, passwd)
+			if err != nil {
+				return nil, err
+			}
+			cipherCache[cacheKey] = cipher
+		}
+		upstreams = append(upstreams, &Upstream{Server: server, Cipher: cipher, Weight: config.ServerWeights[server]})
+	}
+	return upstreams, nil
+}
+
+// Balancers returns the balancer of the servers and those of the server
+// groups, as given by the balance and group_balance options.
+func (config *Config) Balancers() (Balancer, map[string]Balancer, error) {
+	b, err := NewBalancer(config.Balance)
+	if err != nil {
+		return nil, nil, err
+	}
+	groups := make(map[string]Balancer)
+	for name, balance := range config.GroupBalance {
+		if _, ok := config.ServerGroups[name]; !ok {
+			return nil, nil, fmt.Errorf("group_balance: unknown server group %s", name)
+		}
+		if groups[name], err = NewBalancer(balance); err != nil {
+			return nil, nil, err
+		}
+	}
+	return b, groups, nil
+}
+
+// Groups returns the server groups of the server_groups option, the servers
+// are taken from upstreams as returned by Upstreams.
+func (config *Config) Groups(upstreams []*Upstream) (map[string][]*Upstream, error) {
+	groups := make(map[string][]*Upstream)
+	for name, servers := range config.ServerGroups {
+		for _, s := range servers {
+			found := false
+			for _, se := range upstreams {
+				if se.Server == s {
+					groups[name] = append(groups[name], se)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("server %s of group %s not in server_password or server_uris", s, name)
+			}
+		}
+	}
+	return groups, nil
+}
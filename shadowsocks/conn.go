@@ -1,11 +1,14 @@
 package shadowsocks
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"time"
 )
 
 const (
@@ -55,15 +58,85 @@ func RawAddr(addr string) (buf []byte, err error) {
 	return
 }
 
+// rawAddrOf returns the shadowsocks address header of addr. IP addresses are
+// encoded as such, other hosts as domain names.
+func rawAddrOf(addr net.Addr) ([]byte, error) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("shadowsocks: address error %s %v", addr, err)
+	}
+	if net.ParseIP(host) == nil {
+		return RawAddr(addr.String())
+	}
+	header, hlen := parseHeaderFromAddr(addr)
+	if header == nil {
+		return nil, fmt.Errorf("shadowsocks: address error %s", addr)
+	}
+	return header[:hlen], nil
+}
+
+// parseRawAddr parses the address header at the start of b, returns the host
+// and port and the length of the header. The one time auth flag in the
+// address type must have been cleared.
+func parseRawAddr(b []byte) (host string, port int, n int, err error) {
+	if len(b) < 1 {
+		return "", 0, 0, errors.New("shadowsocks: address header too short")
+	}
+	switch b[idType] {
+	case typeIPv4:
+		n = lenIPv4
+		if len(b) >= n {
+			host = net.IP(b[idIP0 : idIP0+net.IPv4len]).String()
+		}
+	case typeIPv6:
+		n = lenIPv6
+		if len(b) >= n {
+			host = net.IP(b[idIP0 : idIP0+net.IPv6len]).String()
+		}
+	case typeDm:
+		if len(b) < idDmLen+1 {
+			return "", 0, 0, errors.New("shadowsocks: address header too short")
+		}
+		n = int(b[idDmLen]) + lenDmBase
+		if len(b) >= n {
+			host = string(b[idDm0 : idDm0+int(b[idDmLen])])
+		}
+	default:
+		return "", 0, 0, fmt.Errorf("shadowsocks: addr type %d not supported", b[idType])
+	}
+	if len(b) < n {
+		return "", 0, 0, errors.New("shadowsocks: address header too short")
+	}
+	port = int(binary.BigEndian.Uint16(b[n-2 : n]))
+	return
+}
+
 // This is intended for use by users implementing a local socks proxy.
 // rawaddr shoud contain part of the data in socks request, starting from the
 // ATYP field. (Refer to rfc1928 for more information.)
 func DialWithRawAddr(rawaddr []byte, server string, cipher *Cipher) (c *Conn, err error) {
-	conn, err := net.Dial("tcp", server)
+	return DialWithRawAddrContext(context.Background(), rawaddr, server, cipher)
+}
+
+// DialWithRawAddrContext is like DialWithRawAddr, but connecting to the
+// server and sending the request header are aborted when ctx is done.
+func DialWithRawAddrContext(ctx context.Context, rawaddr []byte, server string, cipher *Cipher) (c *Conn, err error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", server)
 	if err != nil {
 		return
 	}
 	c = NewConn(conn, cipher)
+	stop := watchContext(ctx, conn)
+	defer func() {
+		if stop() {
+			err = ctx.Err()
+		}
+		if err != nil {
+			c.Close()
+			c = nil
+		}
+	}()
 	if cipher.ota {
 		if c.enc == nil {
 			if _, err = c.initEncrypt(); err != nil {
@@ -71,24 +144,63 @@ func DialWithRawAddr(rawaddr []byte, server string, cipher *Cipher) (c *Conn, er
 			}
 		}
 		// since we have initEncrypt, we must send iv manually
-		conn.Write(cipher.iv)
-		rawaddr[0] |= OneTimeAuthMask
+		if _, err = conn.Write(cipher.iv); err != nil {
+			return
+		}
+		// modify a copy, rawaddr may be shared by concurrent connections or
+		// used again with the next server
+		rawaddr = append([]byte{rawaddr[0] | OneTimeAuthMask}, rawaddr[1:]...)
 		rawaddr = otaConnectAuth(cipher.iv, cipher.key, rawaddr)
 	}
-	if _, err = c.write(rawaddr); err != nil {
-		c.Close()
-		return nil, err
-	}
+	_, err = c.write(rawaddr)
 	return
 }
 
+// aLongTimeAgo is used as deadline to interrupt blocking I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchContext interrupts I/O on conn when ctx is done. The returned function
+// must be called when I/O is done, it clears the deadline and reports whether
+// I/O has been interrupted.
+func watchContext(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		intr := <-interrupted
+		conn.SetDeadline(time.Time{})
+		return intr || ctx.Err() != nil
+	}
+}
+
 // addr should be in the form of host:port
 func Dial(addr, server string, cipher *Cipher) (c *Conn, err error) {
+	return DialContext(context.Background(), addr, server, cipher)
+}
+
+// DialContext is like Dial, but connecting to the server and sending the
+// request header are aborted when ctx is done.
+func DialContext(ctx context.Context, addr, server string, cipher *Cipher) (c *Conn, err error) {
 	ra, err := RawAddr(addr)
 	if err != nil {
 		return
 	}
-	return DialWithRawAddr(ra, server, cipher)
+	return DialWithRawAddrContext(ctx, ra, server, cipher)
 }
 
 func (c *Conn) GetIv() (iv []byte) {
@@ -182,5 +294,11 @@ func (c *Conn) write(b []byte) (n int, err error) {
 
 	c.encrypt(cipherData[len(iv):], b)
 	n, err = c.Conn.Write(cipherData)
+	// The iv is not part of b.
+	if n >= len(iv) {
+		n -= len(iv)
+	} else {
+		n = 0
+	}
 	return
 }
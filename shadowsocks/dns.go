@@ -0,0 +1,368 @@
+package shadowsocks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSTimeout   = 5 * time.Second
+	defaultDNSCacheSize = 1000
+	maxDNSPacketSize    = 65535
+)
+
+var errNoResolver = errors.New("dns: no resolver available")
+
+// DNSHandler is the InboundHandler answering DNS queries over TCP, it also
+// answers UDP queries with Local.ServeDNS. Queries are forwarded over TCP to
+// Resolvers through the shadowsocks servers, so they don't leak to the local
+// network, except for DirectDomains. Responses are cached until their TTL
+// expires.
+type DNSHandler struct {
+	// Resolvers are the upstream resolvers reached through the servers,
+	// tried in order. Port 53 is used if not specified.
+	Resolvers []string
+	// DirectResolvers are queried directly over UDP for DirectDomains.
+	DirectResolvers []string
+	// DirectDomains are the domains resolved directly, including their
+	// subdomains.
+	DirectDomains []string
+	// CacheSize is the maximum number of cached responses, default to 1000.
+	// Negative disables the cache.
+	CacheSize int
+	// Timeout is the time given to each resolver, default to 5 seconds.
+	Timeout time.Duration
+
+	once  sync.Once
+	cache *dnsCache
+}
+
+// dnsAddr adds the default port to resolver addresses without port.
+func dnsAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+	return addr
+}
+
+func (h *DNSHandler) init() {
+	size := h.CacheSize
+	if size == 0 {
+		size = defaultDNSCacheSize
+	}
+	if size > 0 {
+		h.cache = newDNSCache(size)
+	}
+}
+
+func (h *DNSHandler) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return defaultDNSTimeout
+}
+
+// target returns the first resolver, reported as the target of the inbound
+// connections.
+func (h *DNSHandler) target() string {
+	if len(h.Resolvers) > 0 {
+		return dnsAddr(h.Resolvers[0])
+	}
+	return ""
+}
+
+// isDirect reports whether name is one of DirectDomains or their subdomains.
+func (h *DNSHandler) isDirect(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, d := range h.DirectDomains {
+		d = strings.ToLower(strings.Trim(d, "."))
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve answers the query, from the cache if possible.
+func (h *DNSHandler) resolve(ctx context.Context, l *Local, query []byte) ([]byte, error) {
+	h.once.Do(h.init)
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	key := dnsCacheKey(q)
+	if h.cache != nil {
+		if resp := h.cache.get(key, hdr.ID); resp != nil {
+			return resp, nil
+		}
+	}
+	var resp []byte
+	if h.isDirect(q.Name.String()) {
+		resp, err = h.exchangeDirect(ctx, query)
+	} else {
+		resp, err = h.exchange(ctx, l, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h.cache != nil {
+		h.cache.put(key, resp)
+	}
+	return resp, nil
+}
+
+// exchange sends the query over TCP to the resolvers through the servers.
+func (h *DNSHandler) exchange(ctx context.Context, l *Local, query []byte) (resp []byte, err error) {
+	err = errNoResolver
+	for _, r := range h.Resolvers {
+		r = dnsAddr(r)
+		if resp, err = h.exchangeTCP(ctx, l, r, query); err == nil {
+			return
+		}
+		l.logger().Log(LevelWarn, "dns query failed", F(KeyTarget, r), F(KeyError, err))
+	}
+	return
+}
+
+func (h *DNSHandler) exchangeTCP(ctx context.Context, l *Local, resolver string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+	rawaddr, err := RawAddr(resolver)
+	if err != nil {
+		return nil, err
+	}
+	// resolvers are always reached through the servers, whatever Router says
+	remote, err := l.connectServers(ctx, rawaddr, resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Close()
+	deadline, _ := ctx.Deadline()
+	remote.SetDeadline(deadline)
+	if err = writeDNSTCP(remote, query); err != nil {
+		return nil, err
+	}
+	return readDNSTCP(remote)
+}
+
+// exchangeDirect sends the query over UDP to the direct resolvers.
+func (h *DNSHandler) exchangeDirect(ctx context.Context, query []byte) (resp []byte, err error) {
+	err = errNoResolver
+	for _, r := range h.DirectResolvers {
+		if resp, err = h.exchangeUDP(ctx, dnsAddr(r), query); err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (h *DNSHandler) exchangeUDP(ctx context.Context, resolver string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	deadline, _ := ctx.Deadline()
+	c.SetDeadline(deadline)
+	if _, err = c.Write(query); err != nil {
+		return nil, err
+	}
+	id := query[:2]
+	buf := make([]byte, maxDNSPacketSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore responses to other queries
+		if n >= 2 && buf[0] == id[0] && buf[1] == id[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// writeDNSTCP writes a DNS message prefixed with its length.
+func writeDNSTCP(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readDNSTCP reads a DNS message prefixed with its length.
+func readDNSTCP(r io.Reader) ([]byte, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// serverFailure returns the SERVFAIL response to query, or nil if query is
+// invalid.
+func serverFailure(query []byte) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               hdr.ID,
+			Response:         true,
+			OpCode:           hdr.OpCode,
+			RecursionDesired: hdr.RecursionDesired,
+			RCode:            dnsmessage.RCodeServerFailure,
+		},
+		Questions: questions,
+	}
+	resp, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// udpResponse returns resp if it fits in the UDP payload size of the client,
+// 512 bytes or the size advertised with EDNS0 in query. Otherwise only the
+// questions are kept and the TC bit is set, so the client retries over TCP.
+func udpResponse(query, resp []byte) []byte {
+	size := maxUDPDNSSize(query)
+	if len(resp) <= size {
+		return resp
+	}
+	var p dnsmessage.Parser
+	hdr, err := p.Start(resp)
+	if err != nil {
+		return nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil
+	}
+	hdr.Truncated = true
+	msg := dnsmessage.Message{Header: hdr, Questions: questions}
+	b, err := msg.Pack()
+	if err != nil || len(b) > size {
+		return nil
+	}
+	return b
+}
+
+// maxUDPDNSSize returns the UDP payload size the client of query accepts.
+func maxUDPDNSSize(query []byte) int {
+	const minSize = 512
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return minSize
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return minSize
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return minSize
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return minSize
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return minSize
+		}
+		// the class of the OPT record is the UDP payload size
+		if h.Type == dnsmessage.TypeOPT {
+			if size := int(h.Class); size > minSize {
+				return size
+			}
+			return minSize
+		}
+		if err = p.SkipAdditional(); err != nil {
+			return minSize
+		}
+	}
+}
+
+// ServeInbound answers DNS queries over TCP.
+func (h *DNSHandler) ServeInbound(ctx context.Context, conn net.Conn, l *Local) {
+	lg := l.logger()
+	id := accessEntry(ctx).ConnID
+	l.Handshake(ctx, h.target(), "")
+	for {
+		setReadTimeout(conn, l.timeout())
+		query, err := readDNSTCP(conn)
+		if err != nil {
+			if err != io.EOF && !isClosedConnError(err) {
+				lg.Log(LevelDebug, "error reading dns query", F(KeyConnID, id), F(KeyError, err))
+			}
+			return
+		}
+		resp, err := h.resolve(ctx, l, query)
+		if err != nil {
+			lg.Log(LevelDebug, "dns resolve failed", F(KeyConnID, id), F(KeyError, err))
+			if resp = serverFailure(query); resp == nil {
+				return
+			}
+		}
+		if err = writeDNSTCP(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// ServeDNS answers the DNS queries received on conn with h. Like Serve,
+// ErrServerClosed is returned after Shutdown or Close.
+func (l *Local) ServeDNS(conn net.PacketConn, h *DNSHandler) error {
+	if !l.trackPacketConn(conn, newLocalUDPRelay(), true) {
+		return ErrServerClosed
+	}
+	defer l.trackPacketConn(conn, nil, false)
+	buf := make([]byte, maxDNSPacketSize)
+	for {
+		n, src, err := conn.ReadFrom(buf)
+		if err != nil {
+			if l.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go func(query []byte) {
+			resp, err := h.resolve(context.Background(), l, query)
+			if err != nil {
+				l.logf(LevelDebug, "dns resolve for %s failed: %v", src, err)
+				if resp = serverFailure(query); resp == nil {
+					return
+				}
+			}
+			if resp = udpResponse(query, resp); resp == nil {
+				return
+			}
+			conn.WriteTo(resp, src)
+		}(append([]byte(nil), buf[:n]...))
+	}
+}
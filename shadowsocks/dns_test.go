@@ -0,0 +1,370 @@
+package shadowsocks
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func dnsQuery(t *testing.T, id uint16, name string) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// dnsAnswer answers query with an A record of ip.
+func dnsAnswer(query []byte, ip [4]byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil
+	}
+	msg.Response = true
+	msg.Answers = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{
+			Name:  msg.Questions[0].Name,
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   60,
+		},
+		Body: &dnsmessage.AResource{A: ip},
+	}}
+	b, _ := msg.Pack()
+	return b
+}
+
+// checkDNSAnswer checks resp is the answer with ip to the query with id.
+func checkDNSAnswer(t *testing.T, resp []byte, id uint16, ip [4]byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != id {
+		t.Errorf("response id %d, want %d", msg.ID, id)
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+		t.Fatalf("response %v, want one answer", msg.GoString())
+	}
+	if a, ok := msg.Answers[0].Body.(*dnsmessage.AResource); !ok || a.A != ip {
+		t.Errorf("answer %v, want %v", msg.Answers[0].Body, ip)
+	}
+}
+
+// startTCPResolver starts a DNS server over TCP answering all queries with ip.
+func startTCPResolver(t *testing.T, ip [4]byte, queries *int32) net.Listener {
+	return startTCPResolverFunc(t, func(query []byte) []byte {
+		return dnsAnswer(query, ip)
+	}, queries)
+}
+
+// startTCPResolverFunc starts a DNS server over TCP answering queries with
+// answer.
+func startTCPResolverFunc(t *testing.T, answer func(query []byte) []byte, queries *int32) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					query, err := readDNSTCP(c)
+					if err != nil {
+						return
+					}
+					atomic.AddInt32(queries, 1)
+					writeDNSTCP(c, answer(query))
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+// startUDPResolver starts a DNS server over UDP answering all queries with ip.
+func startUDPResolver(t *testing.T, ip [4]byte) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(dnsAnswer(buf[:n], ip), addr)
+		}
+	}()
+	return pc
+}
+
+func TestServeDNS(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+	var queries int32
+	remoteIP := [4]byte{1, 2, 3, 4}
+	resolver := startTCPResolver(t, remoteIP, &queries)
+	defer resolver.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLocal([]*Upstream{{Server: srvAddr, Cipher: cipher}}, nil)
+	h := &DNSHandler{Resolvers: []string{resolver.Addr().String()}}
+	go l.ServeDNS(conn, h)
+	defer l.Close()
+
+	c, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	for id := uint16(1); id <= 2; id++ {
+		c.Write(dnsQuery(t, id, "example.com."))
+		buf := make([]byte, 512)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDNSAnswer(t, buf[:n], id, remoteIP)
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("resolver got %d queries, want 1 as the response is cached", n)
+	}
+}
+
+func TestServeDNSTruncate(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+	// 100 A records, too large for 512 bytes
+	var queries int32
+	resolver := startTCPResolverFunc(t, func(query []byte) []byte {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(query); err != nil {
+			return nil
+		}
+		msg.Response = true
+		msg.Additionals = nil
+		for i := 0; i < 100; i++ {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{
+					Name:  msg.Questions[0].Name,
+					Type:  dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET,
+					TTL:   60,
+				},
+				Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, byte(i)}},
+			})
+		}
+		b, _ := msg.Pack()
+		return b
+	}, &queries)
+	defer resolver.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLocal([]*Upstream{{Server: srvAddr, Cipher: cipher}}, nil)
+	h := &DNSHandler{Resolvers: []string{resolver.Addr().String()}}
+	go l.ServeDNS(conn, h)
+	defer l.Close()
+
+	c, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	edns := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 2, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+		Additionals: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName("."),
+				Type:  dnsmessage.TypeOPT,
+				Class: 4096,
+			},
+			Body: &dnsmessage.OPTResource{},
+		}},
+	}
+	ednsQuery, err := edns.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query     []byte
+		truncated bool
+		answers   int
+	}{
+		{dnsQuery(t, 1, "example.com."), true, 0},
+		{ednsQuery, false, 100},
+	}
+	for i, tt := range tests {
+		c.Write(tt.query)
+		buf := make([]byte, maxDNSPacketSize)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg dnsmessage.Message
+		if err = msg.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID != uint16(i+1) || msg.Truncated != tt.truncated || len(msg.Answers) != tt.answers {
+			t.Errorf("response id %d truncated %v with %d answers, want id %d truncated %v with %d answers",
+				msg.ID, msg.Truncated, len(msg.Answers), i+1, tt.truncated, tt.answers)
+		}
+		if tt.truncated && n > 512 {
+			t.Errorf("truncated response of %d bytes", n)
+		}
+	}
+}
+
+func TestDNSHandlerDirect(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+	var queries int32
+	remoteIP, directIP := [4]byte{1, 2, 3, 4}, [4]byte{10, 0, 0, 1}
+	resolver := startTCPResolver(t, remoteIP, &queries)
+	defer resolver.Close()
+	direct := startUDPResolver(t, directIP)
+	defer direct.Close()
+
+	h := &DNSHandler{
+		Resolvers:       []string{resolver.Addr().String()},
+		DirectResolvers: []string{direct.LocalAddr().String()},
+		DirectDomains:   []string{"corp.example"},
+	}
+	l, addr := startLocal(t, []*Upstream{{Server: srvAddr, Cipher: cipher}}, h)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	tests := []struct {
+		name string
+		ip   [4]byte
+	}{
+		{"host.corp.example.", directIP},
+		{"corp.example.", directIP},
+		{"notcorp.example.", remoteIP},
+	}
+	for i, tt := range tests {
+		id := uint16(i + 1)
+		writeDNSTCP(c, dnsQuery(t, id, tt.name))
+		resp, err := readDNSTCP(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDNSAnswer(t, resp, id, tt.ip)
+	}
+
+	// no resolver answers
+	h.Resolvers = []string{unusedAddr(t)}
+	writeDNSTCP(c, dnsQuery(t, 9, "other.example."))
+	resp, err := readDNSTCP(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err = msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 9 || msg.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("response id %d rcode %v, want 9 SERVFAIL", msg.ID, msg.RCode)
+	}
+}
+
+func TestDNSHandlerIgnoresRouter(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+	var queries int32
+	remoteIP := [4]byte{1, 2, 3, 4}
+	resolver := startTCPResolver(t, remoteIP, &queries)
+	defer resolver.Close()
+
+	// the resolver is still reached through the server
+	rules, err := ParseRules(strings.NewReader("MATCH,REJECT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newRecordObserver()
+	h := &DNSHandler{Resolvers: []string{resolver.Addr().String()}}
+	l := NewLocal([]*Upstream{{Server: srvAddr, Cipher: cipher}}, h)
+	l.Router = NewRouter(rules)
+	l.Observer = obs
+	go l.Serve(ln)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	writeDNSTCP(c, dnsQuery(t, 1, "example.com."))
+	resp, err := readDNSTCP(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDNSAnswer(t, resp, 1, remoteIP)
+	c.Close()
+
+	select {
+	case e := <-obs.closed:
+		if e.Target != resolver.Addr().String() {
+			t.Errorf("target %q, want the resolver %s", e.Target, resolver.Addr())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
@@ -0,0 +1,88 @@
+package shadowsocks
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type dnsCacheEntry struct {
+	msg    []byte
+	stored time.Time
+}
+
+// dnsCache keeps DNS responses until their minimum TTL expires.
+type dnsCache struct {
+	cache *ttlCache
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{cache: newTTLCache(size)}
+}
+
+func dnsCacheKey(q dnsmessage.Question) string {
+	return strings.ToLower(q.Name.String()) + " " + q.Type.String() + " " + q.Class.String()
+}
+
+// get returns the cached response with the given ID, TTLs are decreased by the
+// time spent in the cache.
+func (c *dnsCache) get(key string, id uint16) []byte {
+	now := time.Now()
+	v, ok := c.cache.get(key, now)
+	if !ok {
+		return nil
+	}
+	e := v.(*dnsCacheEntry)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(e.msg); err != nil {
+		return nil
+	}
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range section {
+			h := &section[i].Header
+			// the TTL of OPT records holds flags
+			if h.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if h.TTL > elapsed {
+				h.TTL -= elapsed
+			} else {
+				h.TTL = 0
+			}
+		}
+	}
+	msg.ID = id
+	resp, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// put caches resp if it's a successful or NXDOMAIN response with records.
+func (c *dnsCache) put(key string, resp []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return
+	}
+	if msg.Truncated || (msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError) {
+		return
+	}
+	var ttl uint32
+	found := false
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities} {
+		for _, r := range section {
+			if !found || r.Header.TTL < ttl {
+				ttl, found = r.Header.TTL, true
+			}
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+	now := time.Now()
+	e := &dnsCacheEntry{msg: append([]byte(nil), resp...), stored: now}
+	c.cache.put(key, e, now.Add(time.Duration(ttl)*time.Second), now)
+}
@@ -1,6 +1,7 @@
 package shadowsocks
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/des"
@@ -222,6 +223,16 @@ func NewCipher(method, password string) (c *Cipher, err error) {
 	return c, nil
 }
 
+// equal reports whether c and o have the same method and key.
+func (c *Cipher) equal(o *Cipher) bool {
+	return c.info == o.info && c.ota == o.ota && bytes.Equal(c.key, o.key)
+}
+
+// IsOta reports whether one time auth is enabled for the cipher.
+func (c *Cipher) IsOta() bool {
+	return c.ota
+}
+
 // Initializes the block cipher with CFB mode, returns IV.
 func (c *Cipher) initEncrypt() (iv []byte, err error) {
 	if c.iv == nil {
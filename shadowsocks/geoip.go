@@ -0,0 +1,109 @@
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	defaultHostCacheSize = 1000
+	hostCacheTTL         = 10 * time.Minute
+	// lookup failures are cached too, not to wait for the resolver on each
+	// connection
+	hostCacheFailTTL = 30 * time.Second
+	lookupTimeout    = 5 * time.Second
+)
+
+var errLookupTimeout = errors.New("lookup timed out")
+
+// GeoIP finds the country of IP addresses in a MaxMind database file
+// (.mmdb), such as GeoLite2-Country, without network access.
+type GeoIP struct {
+	db *maxminddb.Reader
+}
+
+// OpenGeoIP opens the database at path.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoIP{db: db}, nil
+}
+
+// Country returns the upper case ISO 3166-1 code of the country of ip, or
+// the empty string if it's not found.
+func (g *GeoIP) Country(ip net.IP) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+	if err := g.db.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	code := record.Country.ISOCode
+	if code == "" {
+		code = record.RegisteredCountry.ISOCode
+	}
+	return strings.ToUpper(code)
+}
+
+// Close closes the database.
+func (g *GeoIP) Close() error {
+	return g.db.Close()
+}
+
+// hostCache keeps the addresses of domain names resolved by the system
+// resolver, which doesn't give the TTL, for a fixed time.
+type hostCache struct {
+	cache *ttlCache
+	// lookupIP is replaced by tests
+	lookupIP func(host string) ([]net.IP, error)
+}
+
+func newHostCache(size int) *hostCache {
+	return &hostCache{cache: newTTLCache(size), lookupIP: net.LookupIP}
+}
+
+type lookupResult struct {
+	ips []net.IP
+	err error
+}
+
+// lookup returns the addresses of host, nil if it can't be resolved.
+func (c *hostCache) lookup(host string) []net.IP {
+	now := time.Now()
+	if v, ok := c.cache.get(host, now); ok {
+		return v.([]net.IP)
+	}
+
+	// the lookup can't be canceled, it's left running after the timeout
+	ch := make(chan lookupResult, 1)
+	go func() {
+		ips, err := c.lookupIP(host)
+		ch <- lookupResult{ips, err}
+	}()
+	var res lookupResult
+	t := time.NewTimer(lookupTimeout)
+	select {
+	case res = <-ch:
+		t.Stop()
+	case <-t.C:
+		res.err = errLookupTimeout
+	}
+	if res.err != nil {
+		logf(LevelDebug, "error resolving %s: %v", host, res.err)
+		c.cache.put(host, []net.IP(nil), now.Add(hostCacheFailTTL), now)
+		return nil
+	}
+	c.cache.put(host, res.ips, now.Add(hostCacheTTL), now)
+	return res.ips
+}
@@ -0,0 +1,183 @@
+package shadowsocks
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Encoders of the MaxMind DB format, see
+// https://maxmind.github.io/MaxMind-DB/. Only what the fixture needs.
+
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+// mmdbUint encodes v as an uint16 (typ 5) or uint32 (typ 6).
+func mmdbUint(typ byte, v uint32) []byte {
+	var b []byte
+	for ; v != 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return append([]byte{typ<<5 | byte(len(b))}, b...)
+}
+
+// mmdbMap encodes a map of the keys and values in kv.
+func mmdbMap(kv ...[]byte) []byte {
+	b := []byte{7<<5 | byte(len(kv)/2)}
+	for _, v := range kv {
+		b = append(b, v...)
+	}
+	return b
+}
+
+// writeTestMMDB writes an IPv4 database mapping the networks of countries to
+// their country code.
+func writeTestMMDB(t *testing.T, path string, countries map[string]string) {
+	type record struct {
+		kind int // 0 empty, 1 node, 2 data
+		v    int // node index or data offset
+	}
+	nodes := make([][2]record, 1)
+	var data []byte
+	for cidr, code := range countries {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := n.IP.To4()
+		ones, _ := n.Mask.Size()
+		off := len(data)
+		data = append(data, mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString(code)))...)
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> uint(7-i%8) & 1
+			if i == ones-1 {
+				nodes[node][bit] = record{2, off}
+				break
+			}
+			if nodes[node][bit].kind != 1 {
+				nodes = append(nodes, [2]record{})
+				nodes[node][bit] = record{1, len(nodes) - 1}
+			}
+			node = nodes[node][bit].v
+		}
+	}
+
+	count := len(nodes)
+	var buf []byte
+	for _, n := range nodes {
+		for _, r := range n {
+			v := count // no data
+			switch r.kind {
+			case 1:
+				v = r.v
+			case 2:
+				v = count + 16 + r.v
+			}
+			// 24 bits records
+			buf = append(buf, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, "\xab\xcd\xefMaxMind.com"...)
+	buf = append(buf, mmdbMap(
+		mmdbString("node_count"), mmdbUint(6, uint32(count)),
+		mmdbString("record_size"), mmdbUint(5, 24),
+		mmdbString("ip_version"), mmdbUint(5, 4),
+		mmdbString("database_type"), mmdbString("Test-Country"),
+		mmdbString("binary_format_major_version"), mmdbUint(5, 2),
+		mmdbString("binary_format_minor_version"), mmdbUint(5, 0),
+	)...)
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openTestGeoIP opens a database with 1.0.1.0/24 in CN and 8.8.8.0/24 in US.
+func openTestGeoIP(t *testing.T) *GeoIP {
+	dir, err := ioutil.TempDir("", "ss-geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "country.mmdb")
+	writeTestMMDB(t, path, map[string]string{
+		"1.0.1.0/24": "CN",
+		"8.8.8.0/24": "us",
+	})
+	g, err := OpenGeoIP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	g := openTestGeoIP(t)
+	defer g.Close()
+	tests := []struct {
+		ip, country string
+	}{
+		{"1.0.1.5", "CN"},
+		{"8.8.8.8", "US"},
+		{"8.8.9.8", ""},
+		{"127.0.0.1", ""},
+		{"2001:db8::1", ""},
+	}
+	for _, tt := range tests {
+		if c := g.Country(net.ParseIP(tt.ip)); c != tt.country {
+			t.Errorf("Country(%s) = %q, want %q", tt.ip, c, tt.country)
+		}
+	}
+}
+
+func TestRouterGeoIP(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader("GEOIP,cn,DIRECT\nMATCH,PROXY"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter(rules)
+	if rule := r.Match("1.0.1.5:443"); rule.Line != 2 {
+		t.Errorf("rule %v matched without database", rule)
+	}
+	r.GeoIP = openTestGeoIP(t)
+	defer r.GeoIP.Close()
+
+	var lookups int
+	r.once.Do(r.initHosts)
+	r.hosts.lookupIP = func(host string) ([]net.IP, error) {
+		lookups++
+		if host == "cn.example" {
+			return []net.IP{net.ParseIP("1.0.1.1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	tests := []struct {
+		addr    string
+		resolve bool
+		line    int
+	}{
+		{"1.0.1.5:443", false, 1},
+		{"8.8.8.8:443", false, 2},
+		{"cn.example:443", false, 2},
+		{"cn.example:443", true, 1},
+		{"CN.example.:80", true, 1},
+		{"unknown.example:80", true, 2},
+		{"unknown.example:80", true, 2},
+	}
+	for _, tt := range tests {
+		r.Resolve = tt.resolve
+		if rule := r.Match(tt.addr); rule.Line != tt.line {
+			t.Errorf("Match(%q) with resolve %v matched %v, want line %d", tt.addr, tt.resolve, rule, tt.line)
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("%d lookups, want 2 as the results are cached", lookups)
+	}
+}
@@ -0,0 +1,269 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCheckInterval = 30 * time.Second
+	defaultCheckTimeout  = 5 * time.Second
+	defaultCheckFall     = 3
+)
+
+// upstreamCheck is the result of the health checks of an Upstream.
+type upstreamCheck struct {
+	mu    sync.Mutex
+	fails int // consecutive failed probes
+	time  time.Time
+	err   error
+}
+
+// HealthChecker probes servers periodically by fetching an http URL through
+// them, so servers accepting connections but unable to relay them, such as
+// those with another password, are detected. Servers failing Fall probes in a
+// row are marked down until a probe succeeds, Local tries them last. Create
+// it with NewHealthChecker.
+type HealthChecker struct {
+	Servers []*Upstream
+	// ServerList replaces Servers if not nil.
+	ServerList *ServerList
+	// Interval is the time between two probes of a server, default to 30
+	// seconds.
+	Interval time.Duration
+	// Timeout is the time given to each probe, default to 5 seconds.
+	Timeout time.Duration
+	// Fall is the number of failed probes marking a server down, default
+	// to 3.
+	Fall int
+	// Logger replaces the package logger if not nil.
+	Logger Logger
+
+	url  string
+	addr string // host:port of url
+}
+
+// NewHealthChecker returns a checker of servers fetching rawurl, which must
+// be an http URL. Any response is a success, whatever its status.
+func NewHealthChecker(servers []*Upstream, rawurl string) (*HealthChecker, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("health check url %s is not an http URL", rawurl)
+	}
+	addr := u.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "80")
+	}
+	return &HealthChecker{Servers: servers, url: rawurl, addr: addr}, nil
+}
+
+func (h *HealthChecker) interval() time.Duration {
+	if h.Interval > 0 {
+		return h.Interval
+	}
+	return defaultCheckInterval
+}
+
+func (h *HealthChecker) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return defaultCheckTimeout
+}
+
+func (h *HealthChecker) fall() int {
+	if h.Fall > 0 {
+		return h.Fall
+	}
+	return defaultCheckFall
+}
+
+func (h *HealthChecker) servers() []*Upstream {
+	if h.ServerList != nil {
+		servers, _ := h.ServerList.Get()
+		return servers
+	}
+	return h.Servers
+}
+
+// Run probes the servers at once, then every Interval until ctx is done.
+func (h *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval())
+	defer ticker.Stop()
+	for {
+		h.Check(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Check probes all servers concurrently and waits for the results.
+func (h *HealthChecker) Check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, se := range h.servers() {
+		wg.Add(1)
+		go func(se *Upstream) {
+			defer wg.Done()
+			rtt, err := h.probe(ctx, se)
+			if ctx.Err() != nil {
+				// not the fault of the server
+				return
+			}
+			h.record(se, rtt, err)
+		}(se)
+	}
+	wg.Wait()
+}
+
+// probe fetches the URL through se and returns the time taken to get the
+// response header.
+func (h *HealthChecker) probe(ctx context.Context, se *Upstream) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+	rawaddr, err := RawAddr(h.addr)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodHead, h.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Close = true
+	req.Header.Set("User-Agent", "shadowsocks-go")
+
+	start := time.Now()
+	c, err := DialWithRawAddrContext(ctx, rawaddr, se.Server, se.Cipher.Copy())
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	stop := watchContext(ctx, c.Conn)
+	defer stop()
+	if err = req.Write(c); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, err
+	}
+	resp.Body.Close()
+	return time.Since(start), nil
+}
+
+// record updates the state of se with the result of a probe.
+func (h *HealthChecker) record(se *Upstream, rtt time.Duration, err error) {
+	lg := loggerOr(h.Logger)
+	ck := &se.check
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.time, ck.err = time.Now(), err
+	if err != nil {
+		ck.fails++
+		if lg.Enabled(LevelDebug) {
+			lg.Log(LevelDebug, "health check failed", F(KeyServer, se.Server), F(KeyError, err))
+		}
+		if ck.fails == h.fall() {
+			atomic.StoreInt32(&se.down, 1)
+			lg.Log(LevelWarn, "shadowsocks server down", F(KeyServer, se.Server), F(KeyError, err))
+		}
+		return
+	}
+	ck.fails = 0
+	addAverage(&se.rtt, rtt)
+	if lg.Enabled(LevelDebug) {
+		lg.Log(LevelDebug, "health check", F(KeyServer, se.Server), F(KeyDuration, rtt))
+	}
+	if atomic.CompareAndSwapInt32(&se.down, 1, 0) {
+		lg.Log(LevelInfo, "shadowsocks server up", F(KeyServer, se.Server))
+	}
+}
+
+// ServerStatus is the state of a server reported by StatusHandler.
+type ServerStatus struct {
+	Server string `json:"server"`
+	Up     bool   `json:"up"`
+	Active int    `json:"active"`
+	// Failures is the number of consecutive connection failures, and
+	// Breaker the state of the circuit breaker they open.
+	Failures int    `json:"failures"`
+	Breaker  string `json:"breaker"`
+	// Latency in milliseconds, see Upstream.Latency.
+	Latency float64 `json:"latency_ms"`
+	// Time and error of the last health check, if any.
+	Checked    *time.Time `json:"checked,omitempty"`
+	CheckError string     `json:"check_error,omitempty"`
+}
+
+// Status returns the state of the server.
+func (se *Upstream) Status() ServerStatus {
+	s := ServerStatus{
+		Server:   se.Server,
+		Up:       se.Up(),
+		Active:   se.Active(),
+		Failures: se.Failures(),
+		Breaker:  se.Breaker().String(),
+		Latency:  float64(se.Latency()) / float64(time.Millisecond),
+	}
+	se.check.mu.Lock()
+	if !se.check.time.IsZero() {
+		t := se.check.time
+		s.Checked = &t
+	}
+	if se.check.err != nil {
+		s.CheckError = se.check.err.Error()
+	}
+	se.check.mu.Unlock()
+	return s
+}
+
+// StatusHandler is the http.Handler serving the state of the servers as a
+// JSON object, for any path:
+//
+//	{"servers": [{"server": "192.0.2.1:8388", "up": true, ...}, ...]}
+//
+// See ServerStatus for the fields.
+type StatusHandler struct {
+	Servers []*Upstream
+	// ServerList replaces Servers if not nil.
+	ServerList *ServerList
+}
+
+func (h *StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	servers := h.Servers
+	if h.ServerList != nil {
+		servers, _ = h.ServerList.Get()
+	}
+	status := struct {
+		Servers []ServerStatus `json:"servers"`
+	}{make([]ServerStatus, 0, len(servers))}
+	for _, se := range servers {
+		status.Servers = append(status.Servers, se.Status())
+	}
+	b, _ := json.MarshalIndent(status, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(append(b, '\n'))
+}
@@ -0,0 +1,139 @@
+package shadowsocks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewHealthChecker(t *testing.T) {
+	for _, u := range []string{"http://www.example.com/generate_204", "http://192.0.2.1:8080"} {
+		if _, err := NewHealthChecker(nil, u); err != nil {
+			t.Errorf("NewHealthChecker(%q) error %v", u, err)
+		}
+	}
+	for _, u := range []string{"https://www.example.com/", "www.example.com:80", "http:///path"} {
+		if _, err := NewHealthChecker(nil, u); err == nil {
+			t.Errorf("NewHealthChecker(%q) accepted", u)
+		}
+	}
+}
+
+func TestHealthChecker(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewCipher("aes-128-cfb", "barfoo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	srv1, addr1 := startServer(t, cipher)
+	defer srv1.Close()
+	srv2, addr2 := startServer(t, cipher)
+	defer srv2.Close()
+
+	// the first server has another password, the second is down
+	bad := &Upstream{Server: addr1, Cipher: other}
+	dead := &Upstream{Server: unusedAddr(t), Cipher: cipher}
+	good := &Upstream{Server: addr2, Cipher: cipher}
+	h, err := NewHealthChecker([]*Upstream{bad, dead, good}, target.URL+"/generate_204")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Timeout = time.Second
+	h.Fall = 2
+
+	h.Check(context.Background())
+	if !bad.Up() || !dead.Up() {
+		t.Error("servers down after one failed probe")
+	}
+	h.Check(context.Background())
+	if bad.Up() || dead.Up() || !good.Up() {
+		t.Errorf("servers up %v, %v and %v, want false, false and true", bad.Up(), dead.Up(), good.Up())
+	}
+	if good.Latency() <= 0 || bad.Latency() != 0 {
+		t.Errorf("latencies %v and %v", good.Latency(), bad.Latency())
+	}
+
+	// servers down are tried last
+	l := NewLocal([]*Upstream{bad, dead, good}, nil)
+	addr := echo.Addr().String()
+	rawaddr, _ := RawAddr(addr)
+	c, err := l.Connect(context.Background(), rawaddr, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	checkEcho(t, c)
+	if good.Active() != 1 {
+		t.Error("connection not relayed by the server up")
+	}
+	c.Close()
+	if se := l.udpServer(""); se != good {
+		t.Errorf("udp server is %s", se.Server)
+	}
+
+	status := bad.Status()
+	if status.Up || status.Checked == nil || status.CheckError == "" {
+		t.Errorf("got status %+v", status)
+	}
+
+	bad.Cipher = cipher
+	h.Check(context.Background())
+	if !bad.Up() || dead.Up() {
+		t.Errorf("servers up %v and %v after the password is fixed, want true and false", bad.Up(), dead.Up())
+	}
+	if status = bad.Status(); status.CheckError != "" || status.Latency <= 0 {
+		t.Errorf("got status %+v", status)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	servers := testUpstreams(2)
+	servers[0].active = 3
+	servers[1].down = 1
+	servers[1].breaker = breaker{state: int32(BreakerOpen), failures: 2}
+	servers[1].rtt = int64(25 * time.Millisecond)
+	servers[1].latency = int64(time.Millisecond)
+	h := &StatusHandler{Servers: servers}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got content type %q", ct)
+	}
+	var got struct {
+		Servers []ServerStatus `json:"servers"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := []ServerStatus{
+		{Server: "192.0.2.1:8388", Up: true, Active: 3, Breaker: "closed"},
+		{Server: "192.0.2.2:8388", Failures: 2, Breaker: "open", Latency: 25},
+	}
+	if len(got.Servers) != len(want) {
+		t.Fatalf("got %d servers", len(got.Servers))
+	}
+	for i := range want {
+		if got.Servers[i] != want[i] {
+			t.Errorf("server %d status %+v, want %+v", i, got.Servers[i], want[i])
+		}
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST got status %d", w.Code)
+	}
+}
@@ -0,0 +1,296 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var errHTTPScheme = errors.New("http proxy: only http scheme is supported, use CONNECT for https")
+
+// HTTPHandler is the InboundHandler serving HTTP proxy clients. CONNECT
+// requests are tunneled, requests with an absolute http URI are forwarded to
+// the target, keeping both connections alive when possible.
+type HTTPHandler struct {
+	// Users are the username and password pairs accepted in the
+	// Proxy-Authorization header (Basic scheme).
+	Users map[string]string
+	// AuthRequired rejects clients that don't authenticate with Users.
+	AuthRequired bool
+}
+
+// Hop-by-hop headers, which are meaningful only for a single connection and
+// must not be forwarded. Refer to rfc2616 section 13.5.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard but still sent by clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes hop-by-hop headers, including those listed in the
+// Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// bufferedConn reads from r, which buffers data of the embedded Conn.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// countWriter calls count with the number of bytes of each write.
+type countWriter struct {
+	w     io.Writer
+	count func(n int64)
+}
+
+func (w countWriter) Write(b []byte) (n int, err error) {
+	n, err = w.w.Write(b)
+	if n > 0 {
+		w.count(int64(n))
+	}
+	return
+}
+
+// authenticate checks the Proxy-Authorization header. ok is false if the
+// credentials are wrong, or missing while authentication is required.
+func (h *HTTPHandler) authenticate(req *http.Request) (user string, ok bool) {
+	const prefix = "Basic "
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", !h.AuthRequired
+	}
+	if !strings.HasPrefix(auth, prefix) {
+		return "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	i := strings.IndexByte(string(b), ':')
+	if i < 0 {
+		return "", false
+	}
+	user, passwd := string(b[:i]), b[i+1:]
+	expected, found := h.Users[user]
+	if !found || subtle.ConstantTimeCompare([]byte(expected), passwd) != 1 {
+		return user, false
+	}
+	return user, true
+}
+
+// httpError writes a response with the given status code and closes the
+// connection afterwards.
+func httpError(conn net.Conn, code int, header http.Header) {
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Close:      true,
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	resp.Write(conn)
+}
+
+// connectErrorStatus returns the status code of the response to a request
+// whose target can't be connected.
+func connectErrorStatus(err error) int {
+	if err == errRejected {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+func (h *HTTPHandler) ServeInbound(ctx context.Context, conn net.Conn, l *Local) {
+	lg := l.logger()
+	e := accessEntry(ctx)
+	br := bufio.NewReader(conn)
+	f := &httpForwarder{l: l, ctx: ctx, conn: conn, meter: newTransferMeter(l.observer(), e)}
+	defer f.close()
+	for {
+		setReadTimeout(conn, l.timeout())
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF && !isClosedConnError(err) {
+				lg.Log(LevelDebug, "error reading http request", F(KeyConnID, e.ConnID),
+					F(KeyClient, conn.RemoteAddr()), F(KeyError, err))
+			}
+			return
+		}
+		user, ok := h.authenticate(req)
+		if !ok {
+			lg.Log(LevelWarn, "http proxy authentication failed", F(KeyConnID, e.ConnID),
+				F(KeyClient, conn.RemoteAddr()), F(KeyUser, user))
+			httpError(conn, http.StatusProxyAuthRequired,
+				http.Header{"Proxy-Authenticate": {`Basic realm="shadowsocks"`}})
+			return
+		}
+		if req.Method == http.MethodConnect {
+			h.connect(ctx, &bufferedConn{conn, br}, l, req, user)
+			return
+		}
+		if !f.forward(req, user) {
+			return
+		}
+	}
+}
+
+// connect tunnels the connection to the target of a CONNECT request.
+func (h *HTTPHandler) connect(ctx context.Context, conn net.Conn, l *Local, req *http.Request, user string) {
+	e := accessEntry(ctx)
+	addr := req.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+	rawaddr, err := RawAddr(addr)
+	if err != nil {
+		httpError(conn, http.StatusBadRequest, nil)
+		return
+	}
+	l.Handshake(ctx, addr, user)
+	remote, err := l.Connect(ctx, rawaddr, addr)
+	if err != nil {
+		l.logger().Log(LevelWarn, "http connect failed", F(KeyConnID, e.ConnID),
+			F(KeyTarget, addr), F(KeyError, err))
+		httpError(conn, connectErrorStatus(err), nil)
+		return
+	}
+	if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		remote.Close()
+		return
+	}
+	l.Relay(ctx, conn, remote)
+}
+
+// httpForwarder forwards plain HTTP requests of a client connection, reusing
+// the connection to the previous target if possible.
+type httpForwarder struct {
+	l     *Local
+	ctx   context.Context
+	conn  net.Conn
+	meter *transferMeter
+
+	target string
+	remote net.Conn
+	br     *bufio.Reader
+}
+
+func (f *httpForwarder) close() {
+	if f.remote != nil {
+		f.remote.Close()
+		f.remote = nil
+	}
+	f.meter.flush()
+}
+
+func (f *httpForwarder) countUp(n int64) {
+	accessEntry(f.ctx).BytesUp += n
+	f.meter.countUp(n)
+}
+
+func (f *httpForwarder) countDown(n int64) {
+	accessEntry(f.ctx).BytesDown += n
+	f.meter.countDown(n)
+}
+
+// dial connects to addr, unless the current remote connection is to it.
+func (f *httpForwarder) dial(addr, user string) error {
+	if f.remote != nil && f.target == addr {
+		return nil
+	}
+	f.close()
+	rawaddr, err := RawAddr(addr)
+	if err != nil {
+		return err
+	}
+	f.l.Handshake(f.ctx, addr, user)
+	remote, err := f.l.Connect(f.ctx, rawaddr, addr)
+	if err != nil {
+		return err
+	}
+	f.target, f.remote, f.br = addr, remote, bufio.NewReader(remote)
+	return nil
+}
+
+// forward sends req to its target and the response back to the client. It
+// returns whether the client connection can be used for more requests.
+func (f *httpForwarder) forward(req *http.Request, user string) bool {
+	e := accessEntry(f.ctx)
+	lg := f.l.logger()
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		lg.Log(LevelWarn, "error getting request", F(KeyConnID, e.ConnID),
+			F(KeyClient, f.conn.RemoteAddr()), F(KeyError, errHTTPScheme))
+		httpError(f.conn, http.StatusBadRequest, nil)
+		return false
+	}
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "80")
+	}
+	if err := f.dial(addr, user); err != nil {
+		lg.Log(LevelWarn, "http forward failed", F(KeyConnID, e.ConnID),
+			F(KeyTarget, addr), F(KeyError, err))
+		httpError(f.conn, connectErrorStatus(err), nil)
+		return false
+	}
+
+	removeHopHeaders(req.Header)
+	closeClient := req.Close
+	// keep the connection to the target alive whatever the client wants
+	req.Close = false
+	if err := req.Write(countWriter{f.remote, f.countUp}); err != nil {
+		lg.Log(LevelDebug, "error writing http request", F(KeyConnID, e.ConnID), F(KeyError, err))
+		e.Reason = CloseReasonOf(err)
+		return false
+	}
+	setReadTimeout(f.remote, f.l.timeout())
+	resp, err := http.ReadResponse(f.br, req)
+	if err != nil {
+		lg.Log(LevelDebug, "error reading http response", F(KeyConnID, e.ConnID), F(KeyError, err))
+		httpError(f.conn, http.StatusBadGateway, nil)
+		e.Reason = CloseReasonOf(err)
+		return false
+	}
+	closeRemote := resp.Close
+	removeHopHeaders(resp.Header)
+	resp.Close = closeClient || closeRemote
+	err = resp.Write(countWriter{f.conn, f.countDown})
+	resp.Body.Close()
+	if err != nil {
+		e.Reason = CloseReasonOf(err)
+		return false
+	}
+	if closeRemote {
+		f.close()
+	}
+	return !resp.Close
+}
@@ -0,0 +1,101 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHTTPProxyConnect(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+	l, addr := startLocal(t, []*Upstream{{Server: srvAddr, Cipher: cipher}}, &HTTPHandler{})
+	defer l.Close()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	target := echo.Addr().String()
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT returned %s", resp.Status)
+	}
+	checkEcho(t, &bufferedConn{c, br})
+}
+
+func TestHTTPProxyForward(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remotes []string
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remotes = append(remotes, r.RemoteAddr)
+		if r.Header.Get("Proxy-Authorization") != "" || r.Header.Get("X-Hop") != "" {
+			t.Errorf("hop-by-hop headers forwarded: %v", r.Header)
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer web.Close()
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+	h := &HTTPHandler{Users: map[string]string{"user": "pass"}, AuthRequired: true}
+	l, addr := startLocal(t, []*Upstream{{Server: srvAddr, Cipher: cipher}}, h)
+	defer l.Close()
+
+	get := func(client *http.Client, path string) *http.Response {
+		req, _ := http.NewRequest("GET", web.URL+path, nil)
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "1")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	proxyURL, _ := url.Parse("http://" + addr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+	resp := get(client, "/")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("request without credentials returned %s", resp.Status)
+	}
+
+	proxyURL.User = url.UserPassword("user", "pass")
+	for _, path := range []string{"/a", "/b"} {
+		resp = get(client, path)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != path {
+			t.Errorf("GET %s returned %s %q", path, resp.Status, body)
+		}
+	}
+	if len(remotes) != 2 || remotes[0] != remotes[1] {
+		t.Errorf("connection to the target not kept alive, requests from %v", remotes)
+	}
+}
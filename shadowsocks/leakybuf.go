@@ -11,6 +11,12 @@ const maxNBuf = 2048
 
 var leakyBuf = NewLeakyBuf(maxNBuf, leakyBufSize)
 
+// maxUDPPacketSize is the largest UDP payload over IPv4.
+const maxUDPPacketSize = 65507
+
+// udpBuf holds UDP packets of any size.
+var udpBuf = NewLeakyBuf(64, maxUDPPacketSize)
+
 // NewLeakyBuf creates a leaky buffer which can hold at most n buffer, each
 // with bufSize bytes.
 func NewLeakyBuf(n, bufSize int) *LeakyBuf {
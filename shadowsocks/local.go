@@ -0,0 +1,517 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errNoServer = errors.New("shadowsocks: no server available")
+
+// Upstream is a shadowsocks server used by Local.
+type Upstream struct {
+	// first for 64-bit alignment on 32-bit platforms
+	latency int64 // in nanoseconds, accessed atomically
+	rtt     int64 // of health checks, in nanoseconds, accessed atomically
+	breaker breaker
+
+	Server string // host:port
+	Cipher *Cipher
+	// Weight is used by the weighted and hash balancers, 0 is taken as 1.
+	Weight int
+
+	active int32 // accessed atomically
+	down   int32 // set by health checks, accessed atomically
+	check  upstreamCheck
+}
+
+func (se *Upstream) weight() int {
+	if se.Weight > 0 {
+		return se.Weight
+	}
+	return 1
+}
+
+// Active returns the number of TCP connections relayed through the server.
+func (se *Upstream) Active() int {
+	return int(atomic.LoadInt32(&se.active))
+}
+
+// Failures returns the number of consecutive connection failures.
+func (se *Upstream) Failures() int {
+	return se.breaker.Failures()
+}
+
+// Breaker returns the state of the circuit breaker of the server, which is
+// open after connection failures.
+func (se *Upstream) Breaker() BreakerState {
+	return se.breaker.State()
+}
+
+// Up reports whether the server passes health checks, true if it's not
+// checked.
+func (se *Upstream) Up() bool {
+	return atomic.LoadInt32(&se.down) == 0
+}
+
+// Latency returns the average time taken to get a response through the
+// server if it's health checked, otherwise to connect to it. 0 if nothing
+// succeeded yet.
+func (se *Upstream) Latency() time.Duration {
+	if rtt := atomic.LoadInt64(&se.rtt); rtt != 0 {
+		return time.Duration(rtt)
+	}
+	return time.Duration(atomic.LoadInt64(&se.latency))
+}
+
+// addLatency updates the moving average of the connection latency with d.
+func (se *Upstream) addLatency(d time.Duration) {
+	addAverage(&se.latency, d)
+}
+
+// addAverage updates the moving average at p with d.
+func addAverage(p *int64, d time.Duration) {
+	avg := atomic.LoadInt64(p)
+	if avg == 0 {
+		avg = int64(d)
+	} else {
+		avg += (int64(d) - avg) / 4
+	}
+	atomic.StoreInt64(p, avg)
+}
+
+// upstreamConn decrements the active connection count of its server when
+// closed.
+type upstreamConn struct {
+	*Conn
+	se   *Upstream
+	once sync.Once
+}
+
+func (c *upstreamConn) Close() error {
+	first := false
+	c.once.Do(func() {
+		atomic.AddInt32(&c.se.active, -1)
+		first = true
+	})
+	if !first {
+		// closing Conn again would put its buffers back twice
+		return c.Conn.Conn.Close()
+	}
+	return c.Conn.Close()
+}
+
+// InboundHandler implements the protocol spoken by the clients of Local, such
+// as SOCKS5. It reads the request from conn, reports it with l.Handshake,
+// connects to the target with l.Connect and relays data with l.Relay. ctx
+// identifies the connection for the events sent to the observer and must be
+// passed to these methods. conn is closed when ServeInbound returns.
+type InboundHandler interface {
+	ServeInbound(ctx context.Context, conn net.Conn, l *Local)
+}
+
+// InboundHandlerFunc allows using ordinary functions as InboundHandler.
+type InboundHandlerFunc func(ctx context.Context, conn net.Conn, l *Local)
+
+func (f InboundHandlerFunc) ServeInbound(ctx context.Context, conn net.Conn, l *Local) {
+	f(ctx, conn, l)
+}
+
+type accessEntryKey struct{}
+
+// accessEntry returns the entry of the connection identified by ctx. A new
+// entry is returned if ctx doesn't come from Local, so handlers can be used
+// on their own.
+func accessEntry(ctx context.Context) *AccessEntry {
+	if e, ok := ctx.Value(accessEntryKey{}).(*AccessEntry); ok {
+		return e
+	}
+	return &AccessEntry{ConnID: NewConnID(), Network: "tcp", Start: time.Now()}
+}
+
+// Local is a shadowsocks client accepting connections from local programs and
+// relaying them through the shadowsocks servers. Create it with NewLocal.
+// Options must not be changed after calling Serve, except the timeouts with
+// SetTimeouts.
+type Local struct {
+	// Servers are tried in the order chosen by Balancer, those marked down
+	// by a HealthChecker last. On connection failure, the next server is
+	// tried.
+	Servers []*Upstream
+	Handler InboundHandler
+	// Balancer orders Servers, and the groups without their own balancer
+	// in GroupBalancers, for each connection. Servers are tried in order
+	// if nil.
+	Balancer Balancer
+	// GroupBalancers are the balancers of the server groups by name.
+	GroupBalancers map[string]Balancer
+	// Timeout is the read timeout of relayed connections, zero means no
+	// timeout.
+	Timeout time.Duration
+	// ConnectTimeout is the time given to each server to establish a
+	// connection, zero means no timeout.
+	ConnectTimeout time.Duration
+	// UDPTimeout is how long a transparent UDP session is kept without
+	// receiving any reply, default to 30 seconds.
+	UDPTimeout time.Duration
+	// Router chooses whether to proxy, connect directly or reject TCP
+	// connections by their target. All connections are proxied if nil.
+	Router *Router
+	// Groups are the server groups used by the rules of Router. Their
+	// servers should also be in Servers to be used for UDP.
+	Groups map[string][]*Upstream
+	// ServerList replaces Servers and Groups if not nil, so that they can
+	// be replaced while serving. Its balancers replace Balancer and
+	// GroupBalancers once set.
+	ServerList *ServerList
+	// Observer receives the events of relayed connections if not nil.
+	Observer Observer
+	// Logger replaces the package logger if not nil.
+	Logger Logger
+
+	connTracker
+	packetConns map[net.PacketConn]*localUDPRelay // guarded by connTracker.mu
+
+	timeoutMu sync.RWMutex // guards Timeout and ConnectTimeout
+}
+
+// NewLocal returns a client using servers. SOCKS5 without authentication is
+// served if handler is nil.
+func NewLocal(servers []*Upstream, handler InboundHandler) *Local {
+	if handler == nil {
+		handler = &SOCKS5Handler{}
+	}
+	return &Local{Servers: servers, Handler: handler}
+}
+
+// acceptRetryDelay is how long Serve waits after a temporary accept error,
+// such as running out of file descriptors.
+const acceptRetryDelay = 50 * time.Millisecond
+
+// SetTimeouts replaces Timeout and ConnectTimeout, also while serving. The
+// established connections keep their read timeout.
+func (l *Local) SetTimeouts(timeout, connectTimeout time.Duration) {
+	l.timeoutMu.Lock()
+	l.Timeout, l.ConnectTimeout = timeout, connectTimeout
+	l.timeoutMu.Unlock()
+}
+
+func (l *Local) timeout() time.Duration {
+	l.timeoutMu.RLock()
+	defer l.timeoutMu.RUnlock()
+	return l.Timeout
+}
+
+func (l *Local) connectTimeout() time.Duration {
+	l.timeoutMu.RLock()
+	defer l.timeoutMu.RUnlock()
+	return l.ConnectTimeout
+}
+
+func (l *Local) logger() Logger {
+	return loggerOr(l.Logger)
+}
+
+func (l *Local) logf(level LogLevel, format string, args ...interface{}) {
+	logfTo(l.logger(), level, format, args...)
+}
+
+func (l *Local) observer() Observer {
+	if l.Observer != nil {
+		return l.Observer
+	}
+	return NopObserver{}
+}
+
+// ListenAndServe listens on the TCP address addr and calls Serve.
+func (l *Local) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return l.Serve(ln)
+}
+
+// Serve accepts connections on ln and passes them to the handler. The
+// listener is closed by Shutdown and Close, in which case ErrServerClosed is
+// returned.
+func (l *Local) Serve(ln net.Listener) error {
+	if !l.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer l.trackListener(ln, false)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if l.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				l.logf(LevelWarn, "accept: %v", err)
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+			return err
+		}
+		if !l.trackConn(conn, true) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go l.serveConn(conn, port)
+	}
+}
+
+func (l *Local) serveConn(conn net.Conn, port string) {
+	defer l.trackConn(conn, false)
+	e := &AccessEntry{
+		ConnID:  NewConnID(),
+		Network: "tcp",
+		Client:  conn.RemoteAddr().String(),
+		Port:    port,
+		Start:   time.Now(),
+		// until the handler reports the request
+		Reason: CloseRequestError,
+	}
+	obs := l.observer()
+	obs.Accepted(e)
+	defer obs.Closed(e)
+	defer conn.Close()
+	ctx := context.WithValue(context.Background(), accessEntryKey{}, e)
+	l.Handler.ServeInbound(ctx, conn, l)
+}
+
+// Handshake reports the request read by a handler: the target address and
+// the authenticated user, if any.
+func (l *Local) Handshake(ctx context.Context, target, user string) {
+	e := accessEntry(ctx)
+	e.Target, e.User = target, user
+	e.Reason = CloseEOF
+	l.observer().Handshake(e)
+}
+
+// Shutdown closes the listeners and packet connections, ending UDP sessions,
+// then waits for active connections to finish. If ctx is done before that,
+// remaining connections are closed and ctx.Err() is returned.
+func (l *Local) Shutdown(ctx context.Context) error {
+	l.closeListeners(l.closePacketConns)
+	return l.waitConns(ctx)
+}
+
+// Close closes the listeners, packet connections and active connections
+// immediately.
+func (l *Local) Close() error {
+	l.closeListeners(l.closePacketConns)
+	l.closeConns()
+	return nil
+}
+
+func (l *Local) connectToServer(ctx context.Context, se *Upstream, rawaddr []byte, addr string) (remote *Conn, err error) {
+	parent := ctx
+	if timeout := l.connectTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	lg := l.logger()
+	start := time.Now()
+	remote, err = DialWithRawAddrContext(ctx, rawaddr, se.Server, se.Cipher.Copy())
+	l.observer().Dialed(accessEntry(ctx), se.Server, err)
+	if err != nil {
+		// the client going away or Shutdown is not the fault of the
+		// server, unlike ConnectTimeout
+		if parent.Err() != nil {
+			lg.Log(LevelDebug, "connecting to shadowsocks server canceled",
+				F(KeyServer, se.Server), F(KeyError, err))
+			se.breaker.canceled()
+			return nil, err
+		}
+		lg.Log(LevelWarn, "error connecting to shadowsocks server",
+			F(KeyServer, se.Server), F(KeyError, err))
+		se.breaker.failure(time.Now())
+		return nil, err
+	}
+	if lg.Enabled(LevelDebug) {
+		lg.Log(LevelDebug, "connected", F(KeyTarget, addr), F(KeyServer, se.Server))
+	}
+	se.addLatency(time.Since(start))
+	se.breaker.success()
+	return
+}
+
+// Connect connects to addr through the servers in the order specified. On
+// connection failure, try the next server. A failed server is skipped until
+// its circuit breaker allows a retry, so we can discover recovered servers.
+// Each server is given ConnectTimeout to connect, ctx can abort the whole
+// process. rawaddr is the shadowsocks address header of addr, as returned by
+// RawAddr.
+//
+// If Router is set, the target may be connected directly or rejected with
+// an error instead.
+func (l *Local) Connect(ctx context.Context, rawaddr []byte, addr string) (remote net.Conn, err error) {
+	e := accessEntry(ctx)
+	servers, groups := l.upstreams()
+	group := ""
+	if l.Router != nil {
+		if rule := l.Router.Match(addr); rule != nil {
+			if lg := l.logger(); lg.Enabled(LevelDebug) {
+				lg.Log(LevelDebug, "rule matched", F(KeyConnID, e.ConnID), F(KeyTarget, addr), F("rule", rule))
+			}
+			switch rule.Action {
+			case ActionReject:
+				e.Reason = CloseRejected
+				return nil, errRejected
+			case ActionDirect:
+				if remote, err = l.dialDirect(ctx, addr); err != nil {
+					e.Reason = CloseDialError
+				}
+				return
+			}
+			if rule.Group != "" {
+				servers, group = groups[rule.Group], rule.Group
+			}
+		}
+	}
+	remote, err = l.connect(ctx, l.balancer(group).Pick(servers, addr), rawaddr, addr)
+	if err != nil {
+		e.Reason = CloseDialError
+	}
+	return
+}
+
+// connectServers connects to addr through the servers like Connect, but
+// ignores Router, so the connection never goes out directly.
+func (l *Local) connectServers(ctx context.Context, rawaddr []byte, addr string) (net.Conn, error) {
+	servers, _ := l.upstreams()
+	return l.connect(ctx, l.balancer("").Pick(servers, addr), rawaddr, addr)
+}
+
+// targetError is the error connecting directly to the target. Errors
+// connecting to a server say nothing about the target.
+type targetError struct {
+	err error
+}
+
+func (e *targetError) Error() string {
+	return e.err.Error()
+}
+
+// dialDirect connects to addr without the servers, errors are *targetError.
+func (l *Local) dialDirect(ctx context.Context, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: l.connectTimeout()}
+	remote, err := d.DialContext(ctx, "tcp", addr)
+	l.observer().Dialed(accessEntry(ctx), addr, err)
+	if err != nil {
+		l.logger().Log(LevelWarn, "error connecting directly", F(KeyTarget, addr), F(KeyError, err))
+		return nil, &targetError{err}
+	}
+	return remote, nil
+}
+
+// upstreams returns the servers and groups, from ServerList if set.
+func (l *Local) upstreams() ([]*Upstream, map[string][]*Upstream) {
+	if l.ServerList != nil {
+		return l.ServerList.Get()
+	}
+	return l.Servers, l.Groups
+}
+
+// balancer returns the balancer of the group, "" being Servers, from
+// ServerList if set there.
+func (l *Local) balancer(group string) Balancer {
+	balancer, groups := l.Balancer, l.GroupBalancers
+	if l.ServerList != nil {
+		if b, g, ok := l.ServerList.Balancers(); ok {
+			balancer, groups = b, g
+		}
+	}
+	if b := groups[group]; b != nil {
+		return b
+	}
+	if balancer != nil {
+		return balancer
+	}
+	return BalancerFunc(failover)
+}
+
+// connect tries servers in order, skipping those which failed recently
+// most of the time.
+func (l *Local) connect(ctx context.Context, servers []*Upstream, rawaddr []byte, addr string) (remote net.Conn, err error) {
+	err = errNoServer
+	skipped := make([]*Upstream, 0)
+	for _, se := range servers {
+		// skip servers down, and failed servers until their breaker
+		// allows a retry
+		if !se.Up() || !se.breaker.allow(time.Now()) {
+			skipped = append(skipped, se)
+			continue
+		}
+		var c *Conn
+		if c, err = l.connectToServer(ctx, se, rawaddr, addr); err == nil {
+			return l.track(se, c), nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	// last resort, try skipped servers, not likely to succeed
+	for _, se := range skipped {
+		var c *Conn
+		if c, err = l.connectToServer(ctx, se, rawaddr, addr); err == nil {
+			return l.track(se, c), nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// track counts the connection c to se as active until it's closed.
+func (l *Local) track(se *Upstream, c *Conn) net.Conn {
+	atomic.AddInt32(&se.active, 1)
+	return &upstreamConn{Conn: c, se: se}
+}
+
+// udpServer returns the first server up and with its breaker closed in the
+// order of Balancer for addr, which is empty if unknown. As UDP is
+// connectionless, failover is not possible for UDP associations.
+func (l *Local) udpServer(addr string) *Upstream {
+	servers, _ := l.upstreams()
+	if len(servers) == 0 {
+		return nil
+	}
+	servers = l.balancer("").Pick(servers, addr)
+	for _, se := range servers {
+		if se.Up() && se.Breaker() == BreakerClosed {
+			return se
+		}
+	}
+	return servers[0]
+}
+
+// Relay copies data between the client connection conn and remote until
+// either side is done, then closes both. It returns the number of bytes sent
+// each way.
+func (l *Local) Relay(ctx context.Context, conn, remote net.Conn) (up, down int64) {
+	e := accessEntry(ctx)
+	meter := newTransferMeter(l.observer(), e)
+	timeout := l.timeout()
+	var upErr error
+	upDone := make(chan struct{})
+	go func() {
+		up, upErr = pipeThenClose(conn, remote, timeout, l.Logger, e.ConnID, meter.countUp)
+		close(upDone)
+	}()
+	down, downErr := pipeThenClose(remote, conn, timeout, l.Logger, e.ConnID, meter.countDown)
+	// Closing conn stops the other direction.
+	<-upDone
+	meter.flush()
+	e.BytesUp += up
+	e.BytesDown += down
+	e.Reason = CloseReasonOf(upErr, downErr)
+	return
+}
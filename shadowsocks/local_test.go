@@ -0,0 +1,381 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startServer starts a Server on a random local port.
+func startServer(t *testing.T, cipher *Cipher) (*Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(cipher)
+	go srv.Serve(ln)
+	return srv, ln.Addr().String()
+}
+
+// startLocal starts a Local on a random local port.
+func startLocal(t *testing.T, servers []*Upstream, handler InboundHandler) (*Local, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLocal(servers, handler)
+	go l.Serve(ln)
+	return l, ln.Addr().String()
+}
+
+// unusedAddr returns a local address nobody listens on.
+func unusedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// socksConnect does a SOCKS5 CONNECT to target through the proxy at addr.
+func socksConnect(t *testing.T, addr, target string, auth []byte) net.Conn {
+	c, _ := socksRequest(t, addr, target, auth)
+	return c
+}
+
+// socksRequest is socksConnect also returning the reply, which must have an
+// IPv4 address.
+func socksRequest(t *testing.T, addr, target string, auth []byte) (net.Conn, []byte) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if auth == nil {
+		c.Write([]byte{socksVer5, 1, socksMethodNoAuth})
+	} else {
+		c.Write([]byte{socksVer5, 1, socksMethodUserPass})
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if auth != nil {
+		if reply[1] != socksMethodUserPass {
+			t.Fatalf("method %d selected, want user/pass", reply[1])
+		}
+		c.Write(auth)
+		if _, err = io.ReadFull(c, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply[1] != 0 {
+			c.Close()
+			return nil, nil
+		}
+	}
+	rawaddr, err := RawAddr(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write(append([]byte{socksVer5, socksCmdConnect, 0}, rawaddr...))
+	reply = make([]byte, 10)
+	if _, err = io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	return c, reply
+}
+
+func checkEcho(t *testing.T, c net.Conn) {
+	msg := []byte("hello")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Errorf("got %q, want %q", buf, msg)
+	}
+}
+
+func TestLocalSOCKS5Failover(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+
+	dead := &Upstream{Server: unusedAddr(t), Cipher: cipher}
+	l, addr := startLocal(t, []*Upstream{dead, {Server: srvAddr, Cipher: cipher}}, nil)
+	defer l.Close()
+
+	c := socksConnect(t, addr, echo.Addr().String(), nil)
+	defer c.Close()
+	checkEcho(t, c)
+	if dead.Failures() != 1 || dead.Breaker() != BreakerOpen {
+		t.Errorf("dead server has %d failures and breaker %v, want 1 and open", dead.Failures(), dead.Breaker())
+	}
+}
+
+func TestLocalSOCKS5Auth(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+	h := &SOCKS5Handler{Users: map[string]string{"user": "pass"}, AuthRequired: true}
+	l, addr := startLocal(t, []*Upstream{{Server: srvAddr, Cipher: cipher}}, h)
+	defer l.Close()
+
+	if c := socksConnect(t, addr, echo.Addr().String(), []byte("\x01\x04user\x05wrong")); c != nil {
+		c.Close()
+		t.Error("wrong password accepted")
+	}
+	c := socksConnect(t, addr, echo.Addr().String(), []byte("\x01\x04user\x04pass"))
+	if c == nil {
+		t.Fatal("right password rejected")
+	}
+	defer c.Close()
+	checkEcho(t, c)
+}
+
+func TestLocalInboundHandler(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+
+	// forward everything to the echo server
+	target := echo.Addr().String()
+	forward := InboundHandlerFunc(func(ctx context.Context, conn net.Conn, l *Local) {
+		rawaddr, _ := RawAddr(target)
+		l.Handshake(ctx, target, "")
+		remote, err := l.Connect(ctx, rawaddr, target)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		l.Relay(ctx, conn, remote)
+	})
+	l, addr := startLocal(t, []*Upstream{{Server: srvAddr, Cipher: cipher}}, forward)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	checkEcho(t, c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = l.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown with active connection returned %v", err)
+	}
+	if _, err = c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after forced shutdown returned %v, want EOF", err)
+	}
+	c.Close()
+}
+
+func TestLocalUDPAssociateUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ss-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ln, err := net.Listen("unix", filepath.Join(dir, "socks.sock"))
+	if err != nil {
+		t.Skip("unix sockets not supported:", err)
+	}
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLocal([]*Upstream{{Server: unusedAddr(t), Cipher: cipher}}, nil)
+	go l.Serve(ln)
+	defer l.Close()
+
+	c, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte{socksVer5, 1, socksMethodNoAuth})
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte{socksVer5, socksCmdUDPAssociate, 0, typeIPv4, 0, 0, 0, 0, 0, 0})
+	reply = make([]byte, 10)
+	if _, err = io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socksRepGeneralFailure {
+		t.Errorf("reply %d, want general failure", reply[1])
+	}
+}
+
+func TestLocalSOCKS5DeferReply(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+
+	closed := unusedAddr(t)
+	_, closedPort, _ := net.SplitHostPort(closed)
+	rules, err := ParseRules(strings.NewReader(`
+DOMAIN,ads.example,REJECT
+DOMAIN,dead.example,PROXY:dead
+DST-PORT,` + closedPort + `,DIRECT
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLocal([]*Upstream{{Server: srvAddr, Cipher: cipher}}, &SOCKS5Handler{DeferReply: true})
+	l.Router = NewRouter(rules)
+	l.Groups = map[string][]*Upstream{"dead": {{Server: unusedAddr(t), Cipher: cipher}}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.Serve(ln)
+	defer l.Close()
+	addr := ln.Addr().String()
+
+	c, reply := socksRequest(t, addr, echo.Addr().String(), nil)
+	defer c.Close()
+	if reply[1] != socksRepSucceeded || reply[3] != typeIPv4 {
+		t.Fatalf("got reply %v", reply)
+	}
+	// the local address of the connection to the server
+	if bind := net.IP(reply[4:8]); !bind.Equal(net.IPv4(127, 0, 0, 1)) || reply[8] == 0 && reply[9] == 0 {
+		t.Errorf("got bound address %v", reply[4:])
+	}
+	checkEcho(t, c)
+
+	tests := []struct {
+		target string
+		rep    byte
+	}{
+		{"ads.example:443", socksRepNotAllowed},
+		{"dead.example:443", socksRepGeneralFailure},
+		{closed, socksRepConnectionRefused},
+	}
+	for _, tt := range tests {
+		c, reply := socksRequest(t, addr, tt.target, nil)
+		c.Close()
+		if reply[1] != tt.rep {
+			t.Errorf("%s: got reply code %d, want %d", tt.target, reply[1], tt.rep)
+		}
+	}
+}
+
+func TestLocalSOCKS5DeferReplyProbe(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+	// a target speaking first
+	banner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer banner.Close()
+	go func() {
+		for {
+			c, err := banner.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("hello"))
+			c.Close()
+		}
+	}()
+
+	h := &SOCKS5Handler{DeferReply: true, ProbeTimeout: 200 * time.Millisecond}
+	l, addr := startLocal(t, []*Upstream{{Server: srvAddr, Cipher: cipher}}, h)
+	defer l.Close()
+
+	// the server can't connect to the target and closes the connection
+	c, reply := socksRequest(t, addr, unusedAddr(t), nil)
+	c.Close()
+	if reply[1] != socksRepHostUnreachable {
+		t.Errorf("got reply code %d, want host unreachable", reply[1])
+	}
+
+	c, reply = socksRequest(t, addr, banner.Addr().String(), nil)
+	if reply[1] != socksRepSucceeded {
+		t.Fatalf("got reply %v", reply)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(c)
+	c.Close()
+	if string(b) != "hello" {
+		t.Errorf("got %q, %v from the target, want hello", b, err)
+	}
+
+	// no data until the client speaks, success after the timeout
+	c, reply = socksRequest(t, addr, echo.Addr().String(), nil)
+	defer c.Close()
+	if reply[1] != socksRepSucceeded {
+		t.Fatalf("got reply %v", reply)
+	}
+	checkEcho(t, c)
+}
+
+func TestSOCKSErrorReply(t *testing.T) {
+	dialError := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: errno}}
+	}
+	tests := []struct {
+		err error
+		rep byte
+	}{
+		{errRejected, socksRepNotAllowed},
+		{errServerClosed, socksRepHostUnreachable},
+		{errNoServer, socksRepGeneralFailure},
+		// connecting to a server, not the target
+		{dialError(syscall.ECONNREFUSED), socksRepGeneralFailure},
+		{&targetError{dialError(syscall.ECONNREFUSED)}, socksRepConnectionRefused},
+		{&targetError{dialError(syscall.EHOSTUNREACH)}, socksRepHostUnreachable},
+		{&targetError{dialError(syscall.ENETUNREACH)}, socksRepNetworkUnreachable},
+		{&targetError{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "nx.example"}}}, socksRepHostUnreachable},
+		{&targetError{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}}, socksRepHostUnreachable},
+		{&targetError{context.Canceled}, socksRepGeneralFailure},
+	}
+	for _, tt := range tests {
+		if rep := socksErrorReply(tt.err); rep != tt.rep {
+			t.Errorf("socksErrorReply(%v) = %d, want %d", tt.err, rep, tt.rep)
+		}
+	}
+}
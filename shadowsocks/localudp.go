@@ -0,0 +1,225 @@
+package shadowsocks
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// localUDPSession relays the packets from one client to one destination.
+type localUDPSession struct {
+	remote   net.PacketConn // through the shadowsocks server
+	reply    net.PacketConn // sending replies to the client
+	ownReply bool           // reply is closed with the session
+	client   net.Addr
+	dst      net.Addr
+	e        *AccessEntry
+	up       int64 // accessed atomically
+}
+
+// localUDPRelay is the NAT table of a packet connection served by Local,
+// keyed by source and destination.
+type localUDPRelay struct {
+	mu       sync.Mutex
+	closed   bool
+	sessions map[string]*localUDPSession
+}
+
+func newLocalUDPRelay() *localUDPRelay {
+	return &localUDPRelay{sessions: make(map[string]*localUDPSession)}
+}
+
+// closeAll closes all sessions, which ends their reply loops.
+func (r *localUDPRelay) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for _, s := range r.sessions {
+		s.remote.Close()
+	}
+}
+
+func (l *Local) udpTimeout() time.Duration {
+	if l.UDPTimeout > 0 {
+		return l.UDPTimeout
+	}
+	return udpTimeout
+}
+
+func (l *Local) trackPacketConn(pc net.PacketConn, relay *localUDPRelay, add bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if add {
+		if l.closed {
+			return false
+		}
+		if l.packetConns == nil {
+			l.packetConns = make(map[net.PacketConn]*localUDPRelay)
+		}
+		l.packetConns[pc] = relay
+	} else {
+		delete(l.packetConns, pc)
+	}
+	return true
+}
+
+// closePacketConns is called with l.mu held.
+func (l *Local) closePacketConns() {
+	for pc, relay := range l.packetConns {
+		pc.Close()
+		relay.closeAll()
+	}
+}
+
+// servePacket relays the packets of conn through the servers. read returns
+// the source and destination of each packet. The replies of a session are
+// sent with the socket returned by listenReply, or conn if it's nil.
+func (l *Local) servePacket(conn net.PacketConn, read func(b []byte) (n int, src, dst net.Addr, err error),
+	listenReply func(dst net.Addr) (net.PacketConn, error)) error {
+	relay := newLocalUDPRelay()
+	if !l.trackPacketConn(conn, relay, true) {
+		return ErrServerClosed
+	}
+	defer l.trackPacketConn(conn, relay, false)
+	defer relay.closeAll()
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	buf := udpBuf.Get()
+	defer udpBuf.Put(buf)
+	for {
+		n, src, dst, err := read(buf)
+		if err != nil {
+			if l.isClosed() {
+				return ErrServerClosed
+			}
+			if _, ok := err.(net.Error); ok || err == errRedirUnsupported {
+				return err
+			}
+			l.logf(LevelDebug, "[udp]local read: %v", err)
+			continue
+		}
+		s, err := l.udpSession(relay, conn, src, dst, port, listenReply)
+		if err != nil {
+			l.logger().Log(LevelWarn, "error creating udp session", F(KeyClient, src),
+				F(KeyTarget, dst), F(KeyError, err))
+			continue
+		}
+		if _, err = s.remote.WriteTo(buf[:n], dst); err != nil {
+			l.logf(LevelDebug, "[udp]local write to server: %v", err)
+			continue
+		}
+		atomic.AddInt64(&s.up, int64(n))
+	}
+}
+
+// udpSession returns the session from src to dst, creating it if needed. The
+// server is resolved and the sockets are created without holding relay.mu,
+// so that other sessions aren't blocked meanwhile.
+func (l *Local) udpSession(relay *localUDPRelay, conn net.PacketConn, src, dst net.Addr, port string,
+	listenReply func(dst net.Addr) (net.PacketConn, error)) (*localUDPSession, error) {
+	key := src.String() + "-" + dst.String()
+	relay.mu.Lock()
+	s, ok := relay.sessions[key]
+	closed := relay.closed
+	relay.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+	if closed {
+		return nil, ErrServerClosed
+	}
+	se := l.udpServer(dst.String())
+	if se == nil {
+		return nil, errNoServer
+	}
+	d, err := NewDialer(se.Server, se.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := d.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	s = &localUDPSession{
+		remote: remote,
+		reply:  conn,
+		client: src,
+		dst:    dst,
+		e: &AccessEntry{
+			ConnID:  NewConnID(),
+			Network: "udp",
+			Client:  src.String(),
+			Port:    port,
+			Target:  dst.String(),
+			OTA:     se.Cipher.IsOta(),
+			Start:   time.Now(),
+		},
+	}
+	if listenReply != nil {
+		if s.reply, err = listenReply(dst); err != nil {
+			remote.Close()
+			return nil, err
+		}
+		s.ownReply = true
+	}
+
+	relay.mu.Lock()
+	if old, ok := relay.sessions[key]; ok || relay.closed {
+		relay.mu.Unlock()
+		remote.Close()
+		if s.ownReply {
+			s.reply.Close()
+		}
+		if ok {
+			return old, nil
+		}
+		return nil, ErrServerClosed
+	}
+	relay.sessions[key] = s
+	relay.mu.Unlock()
+	l.observer().UDPSessionCreated(s.e)
+	go l.udpReplyLoop(relay, key, s)
+	return s, nil
+}
+
+// udpReplyLoop sends the replies of the session back to the client, until no
+// reply is received for UDPTimeout.
+func (l *Local) udpReplyLoop(relay *localUDPRelay, key string, s *localUDPSession) {
+	buf := udpBuf.Get()
+	defer udpBuf.Put(buf)
+	// The server resolves domain names, so the replies can only be checked
+	// for IP destinations.
+	var checkSrc bool
+	if host, _, err := net.SplitHostPort(s.e.Target); err == nil {
+		checkSrc = net.ParseIP(host) != nil
+	}
+	var down int64
+	var err error
+	for {
+		s.remote.SetReadDeadline(time.Now().Add(l.udpTimeout()))
+		var n int
+		var addr net.Addr
+		if n, addr, err = s.remote.ReadFrom(buf); err != nil {
+			break
+		}
+		// replies from other hosts can't be sent from the reply socket
+		if checkSrc && addr.String() != s.e.Target {
+			continue
+		}
+		if _, err = s.reply.WriteTo(buf[:n], s.client); err != nil {
+			break
+		}
+		down += int64(n)
+	}
+	relay.mu.Lock()
+	delete(relay.sessions, key)
+	relay.mu.Unlock()
+	s.remote.Close()
+	if s.ownReply {
+		s.reply.Close()
+	}
+	s.e.BytesUp = atomic.LoadInt64(&s.up)
+	s.e.BytesDown = down
+	s.e.Reason = CloseReasonOf(err)
+	l.observer().UDPSessionExpired(s.e)
+}
@@ -1,24 +1,280 @@
 package shadowsocks
 
 import (
-	"log"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+type LogLevel int
+
+const (
+	LevelError LogLevel = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+var levelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+func (l LogLevel) String() string {
+	if l < LevelError || l > LevelTrace {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLogLevel converts a level name such as "info" or "debug" to LogLevel.
+// Empty string means LevelInfo.
+func ParseLogLevel(s string) (LogLevel, error) {
+	s = strings.ToLower(s)
+	if s == "" {
+		return LevelInfo, nil
+	}
+	if s == "warning" {
+		s = "warn"
+	}
+	for i, name := range levelNames {
+		if s == name {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, errors.New("unknown log level: " + s)
+}
+
+type LogFormat int
+
+const (
+	LogText LogFormat = iota
+	LogJSON
+)
+
+// ParseLogFormat converts "text" or "json" to LogFormat. Empty string means
+// text.
+func ParseLogFormat(s string) (LogFormat, error) {
+	switch strings.ToLower(s) {
+	case "", "text":
+		return LogText, nil
+	case "json":
+		return LogJSON, nil
+	}
+	return LogText, errors.New("unknown log format: " + s)
+}
+
+// Keys of the fields attached to log entries by this package.
+const (
+	KeyConnID   = "conn_id"
+	KeyPort     = "port"
+	KeyUser     = "user"
+	KeyClient   = "client"
+	KeyTarget   = "target"
+	KeyServer   = "server"
+	KeyBytes    = "bytes"
+	KeyDuration = "duration"
+	KeyError    = "error"
+)
+
+// Field is a key-value pair attached to a log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F is a shorthand for creating a Field.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger is the logging interface used by this package. Library users can
+// provide their own implementation with SetLogger.
+type Logger interface {
+	// Log writes an entry. Implementations must be safe for concurrent use.
+	Log(level LogLevel, msg string, fields ...Field)
+	// Enabled reports whether entries of the given level will be written, so
+	// callers can skip building expensive fields.
+	Enabled(level LogLevel) bool
+}
+
+type stdLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	level  LogLevel
+	format LogFormat
+	buf    bytes.Buffer
+}
+
+// NewLogger returns a Logger writing entries of the given level and below to
+// w. Timestamps are always in UTC.
+func NewLogger(w io.Writer, level LogLevel, format LogFormat) Logger {
+	return &stdLogger{w: w, level: level, format: format}
+}
+
+func (l *stdLogger) Enabled(level LogLevel) bool {
+	return level <= l.level
+}
+
+func (l *stdLogger) Log(level LogLevel, msg string, fields ...Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	now := time.Now().UTC()
+	msg = strings.TrimRight(msg, "\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := &l.buf
+	b.Reset()
+	if l.format == LogJSON {
+		b.WriteString(`{"time":`)
+		writeJSON(b, now.Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		writeJSON(b, level.String())
+		b.WriteString(`,"msg":`)
+		writeJSON(b, msg)
+		for _, f := range fields {
+			b.WriteByte(',')
+			writeJSON(b, f.Key)
+			b.WriteByte(':')
+			writeJSON(b, fieldValue(f.Value))
+		}
+		b.WriteString("}\n")
+	} else {
+		b.WriteString(now.Format("2006-01-02T15:04:05.000Z"))
+		b.WriteByte(' ')
+		b.WriteString(strings.ToUpper(level.String()))
+		b.WriteByte(' ')
+		b.WriteString(msg)
+		for _, f := range fields {
+			b.WriteByte(' ')
+			b.WriteString(f.Key)
+			b.WriteByte('=')
+			s := fmt.Sprint(fieldValue(f.Value))
+			if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+				s = strconv.Quote(s)
+			}
+			b.WriteString(s)
+		}
+		b.WriteByte('\n')
+	}
+	l.w.Write(b.Bytes())
+}
+
+// fieldValue converts values that don't have a useful JSON representation to
+// strings.
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case time.Duration:
+		return v.String()
+	case error:
+		return v.Error()
+	case net.Addr:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+var (
+	loggerMu sync.RWMutex
+	logger   = NewLogger(os.Stdout, LevelInfo, LogText)
+)
+
+// SetLogger replaces the logger used by this package.
+func SetLogger(l Logger) {
+	loggerMu.Lock()
+	logger = l
+	loggerMu.Unlock()
+}
+
+// GetLogger returns the logger used by this package.
+func GetLogger() Logger {
+	loggerMu.RLock()
+	l := logger
+	loggerMu.RUnlock()
+	return l
+}
+
+// Log writes an entry with the package logger.
+func Log(level LogLevel, msg string, fields ...Field) {
+	GetLogger().Log(level, msg, fields...)
+}
+
+func logf(level LogLevel, format string, args ...interface{}) {
+	logfTo(GetLogger(), level, format, args...)
+}
+
+func logfTo(l Logger, level LogLevel, format string, args ...interface{}) {
+	if l.Enabled(level) {
+		l.Log(level, fmt.Sprintf(format, args...))
+	}
+}
+
+// loggerOr returns l, or the package logger if l is nil.
+func loggerOr(l Logger) Logger {
+	if l != nil {
+		return l
+	}
+	return GetLogger()
+}
+
+func Errorf(format string, args ...interface{}) { logf(LevelError, format, args...) }
+func Warnf(format string, args ...interface{})  { logf(LevelWarn, format, args...) }
+func Infof(format string, args ...interface{})  { logf(LevelInfo, format, args...) }
+func Debugf(format string, args ...interface{}) { logf(LevelDebug, format, args...) }
+func Tracef(format string, args ...interface{}) { logf(LevelTrace, format, args...) }
+
+// Fatalf logs at error level then exits the program.
+func Fatalf(format string, args ...interface{}) {
+	logf(LevelError, format, args...)
+	os.Exit(1)
+}
+
+// DebugLog is kept for backward compatibility, new code should use the
+// Logger. When enabled, messages are written at debug level.
 type DebugLog bool
 
 var Debug DebugLog
 
-var dbgLog = log.New(os.Stdout, "[DEBUG] ", log.Ltime)
-
 func (d DebugLog) Printf(format string, args ...interface{}) {
 	if d {
-		dbgLog.Printf(format, args...)
+		logf(LevelDebug, format, args...)
 	}
 }
 
 func (d DebugLog) Println(args ...interface{}) {
 	if d {
-		dbgLog.Println(args...)
+		l := GetLogger()
+		if l.Enabled(LevelDebug) {
+			l.Log(LevelDebug, fmt.Sprintln(args...))
+		}
 	}
 }
+
+var connIDSeq uint64
+
+// NewConnID returns a process wide unique id used to correlate the log
+// entries of a connection.
+func NewConnID() uint64 {
+	return atomic.AddUint64(&connIDSeq, 1)
+}
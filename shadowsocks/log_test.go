@@ -0,0 +1,83 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LevelWarn, LogText)
+	l.Log(LevelInfo, "info message")
+	l.Log(LevelDebug, "debug message")
+	if buf.Len() != 0 {
+		t.Errorf("message below level should be dropped, got %q", buf.String())
+	}
+	l.Log(LevelError, "error message", F(KeyTarget, "example.com:80"), F(KeyError, errors.New("dial failed")))
+	line := buf.String()
+	if !strings.Contains(line, " ERROR error message target=example.com:80 error=\"dial failed\"\n") {
+		t.Errorf("unexpected text log line %q", line)
+	}
+	if !strings.Contains(line, "Z ERROR") {
+		t.Errorf("timestamp should be in UTC, got %q", line)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LevelDebug, LogJSON)
+	l.Log(LevelDebug, "closed", F(KeyConnID, uint64(7)), F(KeyBytes, 1024),
+		F(KeyDuration, 1500*time.Millisecond))
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid json %q: %v", buf.String(), err)
+	}
+	if entry["level"] != "debug" || entry["msg"] != "closed" {
+		t.Errorf("wrong level or msg: %v", entry)
+	}
+	if entry[KeyConnID] != float64(7) || entry[KeyBytes] != float64(1024) {
+		t.Errorf("wrong numeric fields: %v", entry)
+	}
+	if entry[KeyDuration] != "1.5s" {
+		t.Errorf("duration should be formatted as string, got %v", entry[KeyDuration])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry["time"].(string)); err != nil {
+		t.Errorf("wrong time format: %v", err)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for s, want := range map[string]LogLevel{"": LevelInfo, "WARNING": LevelWarn, "trace": LevelTrace} {
+		level, err := ParseLogLevel(s)
+		if err != nil || level != want {
+			t.Errorf("ParseLogLevel(%q) = %v, %v", s, level, err)
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("should reject unknown level")
+	}
+}
+
+func TestPipeLog(t *testing.T) {
+	var buf bytes.Buffer
+	lg := NewLogger(&buf, LevelDebug, LogText)
+	src, client := net.Pipe()
+	dst, _ := net.Pipe()
+	dst.Close()
+	go func() {
+		client.Write([]byte("hello"))
+		client.Close()
+	}()
+	if _, err := pipeThenClose(src, dst, 0, lg, 42, nil); err == nil {
+		t.Error("no error writing to a closed connection")
+	}
+	if line := buf.String(); !strings.Contains(line, " DEBUG pipe write error conn_id=42 error=") {
+		t.Errorf("unexpected log %q", line)
+	}
+}
@@ -0,0 +1,41 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"context"
+	"net"
+)
+
+// MixedHandler is the InboundHandler serving several protocols on one port.
+// The protocol is detected from the first byte sent by the client: 4 is
+// SOCKS4, 5 is SOCKS5 and an upper case letter starts an HTTP method. Nil
+// handlers disable their protocol.
+type MixedHandler struct {
+	SOCKS4 *SOCKS4Handler
+	SOCKS5 *SOCKS5Handler
+	HTTP   *HTTPHandler
+}
+
+func (h *MixedHandler) ServeInbound(ctx context.Context, conn net.Conn, l *Local) {
+	lg := l.logger()
+	br := bufio.NewReader(conn)
+	setReadTimeout(conn, l.timeout())
+	b, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	var handler InboundHandler
+	switch c := b[0]; {
+	case c == socksVer4 && h.SOCKS4 != nil:
+		handler = h.SOCKS4
+	case c == socksVer5 && h.SOCKS5 != nil:
+		handler = h.SOCKS5
+	case 'A' <= c && c <= 'Z' && h.HTTP != nil:
+		handler = h.HTTP
+	default:
+		lg.Log(LevelWarn, "unknown protocol", F(KeyConnID, accessEntry(ctx).ConnID),
+			F(KeyClient, conn.RemoteAddr()), F("first_byte", b[0]))
+		return
+	}
+	handler.ServeInbound(ctx, &bufferedConn{conn, br}, l)
+}
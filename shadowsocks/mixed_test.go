@@ -0,0 +1,105 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// socks4Connect does a SOCKS4 CONNECT to target through the proxy at addr,
+// using the SOCKS4a form if domain is not empty.
+func socks4Connect(t *testing.T, addr, target, domain string) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	host, portStr, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portStr)
+	req := []byte{socksVer4, socksCmdConnect, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], uint16(port))
+	if domain != "" {
+		req = append(req, 0, 0, 0, 1)
+		req = append(req, "user\x00"+domain+"\x00"...)
+	} else {
+		req = append(req, net.ParseIP(host).To4()...)
+		req = append(req, "user\x00"...)
+	}
+	c.Write(req)
+	reply := make([]byte, 8)
+	if _, err = io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks4RepGranted {
+		t.Fatalf("socks4 request rejected with %#x", reply[1])
+	}
+	return c
+}
+
+func TestMixedHandler(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+	h := &MixedHandler{SOCKS4: &SOCKS4Handler{}, SOCKS5: &SOCKS5Handler{}, HTTP: &HTTPHandler{}}
+	l, addr := startLocal(t, []*Upstream{{Server: srvAddr, Cipher: cipher}}, h)
+	defer l.Close()
+	target := echo.Addr().String()
+	_, port, _ := net.SplitHostPort(target)
+
+	t.Run("socks4", func(t *testing.T) {
+		c := socks4Connect(t, addr, target, "")
+		defer c.Close()
+		checkEcho(t, c)
+	})
+	t.Run("socks4a", func(t *testing.T) {
+		c := socks4Connect(t, addr, net.JoinHostPort("0.0.0.1", port), "localhost")
+		defer c.Close()
+		checkEcho(t, c)
+	})
+	t.Run("socks5", func(t *testing.T) {
+		c := socksConnect(t, addr, target, nil)
+		defer c.Close()
+		checkEcho(t, c)
+	})
+	t.Run("http", func(t *testing.T) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT returned %s", resp.Status)
+		}
+		checkEcho(t, &bufferedConn{c, br})
+	})
+	t.Run("unknown", func(t *testing.T) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte{0x16, 3, 1})
+		if _, err = c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("read from unknown protocol connection returned %v, want EOF", err)
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package shadowsocks
+
+import (
+	"sync"
+	"time"
+)
+
+// Observer receives the events of the connections relayed by Server and
+// Local, so that metrics, access logs or billing can be built on top of them.
+//
+// Methods are called synchronously from the relaying goroutines, they must be
+// fast and safe for concurrent use. The entry must not be modified, nor
+// retained after the method returns. Embed NopObserver to implement only some
+// of the methods.
+type Observer interface {
+	// Accepted is called when a TCP connection is accepted. Only ConnID,
+	// Network, Client, Port and Start are set.
+	Accepted(e *AccessEntry)
+	// Handshake is called after the request is read. Target, OTA and User
+	// are set.
+	Handshake(e *AccessEntry)
+	// Dialed is called after trying to connect to addr, which is the target
+	// for Server and a shadowsocks server for Local. err is nil on success.
+	Dialed(e *AccessEntry, addr string, err error)
+	// Transferred is called with the number of bytes relayed since the last
+	// call, at most every few seconds while a TCP connection is active, and
+	// before it's closed if there are bytes not yet reported.
+	Transferred(e *AccessEntry, up, down int64)
+	// Closed is called when a TCP connection ends. Reason and the byte
+	// totals are set.
+	Closed(e *AccessEntry)
+	// UDPSessionCreated is called when the first packet of a UDP session is
+	// relayed.
+	UDPSessionCreated(e *AccessEntry)
+	// UDPSessionExpired is called when a UDP session ends, with Reason and
+	// the byte totals set.
+	UDPSessionExpired(e *AccessEntry)
+}
+
+// NopObserver implements Observer doing nothing.
+type NopObserver struct{}
+
+func (NopObserver) Accepted(e *AccessEntry)                       {}
+func (NopObserver) Handshake(e *AccessEntry)                      {}
+func (NopObserver) Dialed(e *AccessEntry, addr string, err error) {}
+func (NopObserver) Transferred(e *AccessEntry, up, down int64)    {}
+func (NopObserver) Closed(e *AccessEntry)                         {}
+func (NopObserver) UDPSessionCreated(e *AccessEntry)              {}
+func (NopObserver) UDPSessionExpired(e *AccessEntry)              {}
+
+// multiObserver sends events to all its observers in order.
+type multiObserver []Observer
+
+// newMultiObserver returns an observer of the non-nil ones in obs.
+func newMultiObserver(obs ...Observer) Observer {
+	var m multiObserver
+	for _, o := range obs {
+		if o != nil {
+			m = append(m, o)
+		}
+	}
+	if len(m) == 1 {
+		return m[0]
+	}
+	return m
+}
+
+func (m multiObserver) Accepted(e *AccessEntry) {
+	for _, o := range m {
+		o.Accepted(e)
+	}
+}
+
+func (m multiObserver) Handshake(e *AccessEntry) {
+	for _, o := range m {
+		o.Handshake(e)
+	}
+}
+
+func (m multiObserver) Dialed(e *AccessEntry, addr string, err error) {
+	for _, o := range m {
+		o.Dialed(e, addr, err)
+	}
+}
+
+func (m multiObserver) Transferred(e *AccessEntry, up, down int64) {
+	for _, o := range m {
+		o.Transferred(e, up, down)
+	}
+}
+
+func (m multiObserver) Closed(e *AccessEntry) {
+	for _, o := range m {
+		o.Closed(e)
+	}
+}
+
+func (m multiObserver) UDPSessionCreated(e *AccessEntry) {
+	for _, o := range m {
+		o.UDPSessionCreated(e)
+	}
+}
+
+func (m multiObserver) UDPSessionExpired(e *AccessEntry) {
+	for _, o := range m {
+		o.UDPSessionExpired(e)
+	}
+}
+
+// accessLogObserver writes an access log entry for each closed connection
+// and expired UDP session. The package access logger is used if l is nil.
+type accessLogObserver struct {
+	NopObserver
+	l Logger
+}
+
+func (o accessLogObserver) log(e *AccessEntry) {
+	if o.l != nil {
+		logAccess(o.l, e)
+	} else {
+		LogAccess(e)
+	}
+}
+
+func (o accessLogObserver) Closed(e *AccessEntry)            { o.log(e) }
+func (o accessLogObserver) UDPSessionExpired(e *AccessEntry) { o.log(e) }
+
+// closedObserver calls a function for each closed connection and expired UDP
+// session.
+type closedObserver struct {
+	NopObserver
+	f func(e *AccessEntry)
+}
+
+func (o closedObserver) Closed(e *AccessEntry)            { o.f(e) }
+func (o closedObserver) UDPSessionExpired(e *AccessEntry) { o.f(e) }
+
+// transferReportInterval is the minimum interval of Transferred events of a
+// connection.
+var transferReportInterval = 5 * time.Second
+
+// transferMeter accumulates the bytes relayed by a connection and reports
+// them to the observer at most every transferReportInterval.
+type transferMeter struct {
+	obs      Observer
+	e        *AccessEntry
+	mu       sync.Mutex
+	up, down int64 // not yet reported
+	last     time.Time
+}
+
+func newTransferMeter(obs Observer, e *AccessEntry) *transferMeter {
+	return &transferMeter{obs: obs, e: e, last: time.Now()}
+}
+
+func (m *transferMeter) add(up, down int64) {
+	m.mu.Lock()
+	m.up += up
+	m.down += down
+	if time.Since(m.last) < transferReportInterval {
+		m.mu.Unlock()
+		return
+	}
+	up, down = m.up, m.down
+	m.up, m.down = 0, 0
+	m.last = time.Now()
+	m.mu.Unlock()
+	m.obs.Transferred(m.e, up, down)
+}
+
+func (m *transferMeter) countUp(n int64)   { m.add(n, 0) }
+func (m *transferMeter) countDown(n int64) { m.add(0, n) }
+
+// flush reports the bytes not yet reported.
+func (m *transferMeter) flush() {
+	m.mu.Lock()
+	up, down := m.up, m.down
+	m.up, m.down = 0, 0
+	m.mu.Unlock()
+	if up != 0 || down != 0 {
+		m.obs.Transferred(m.e, up, down)
+	}
+}
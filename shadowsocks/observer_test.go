@@ -0,0 +1,190 @@
+package shadowsocks
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordObserver records the events it receives.
+type recordObserver struct {
+	mu       sync.Mutex
+	events   []string
+	up, down int64 // sum of Transferred
+	closed   chan AccessEntry
+}
+
+func newRecordObserver() *recordObserver {
+	return &recordObserver{closed: make(chan AccessEntry, 4)}
+}
+
+func (o *recordObserver) add(ev string) {
+	o.mu.Lock()
+	o.events = append(o.events, ev)
+	o.mu.Unlock()
+}
+
+func (o *recordObserver) Accepted(e *AccessEntry)  { o.add("accepted") }
+func (o *recordObserver) Handshake(e *AccessEntry) { o.add("handshake " + e.Target) }
+func (o *recordObserver) Dialed(e *AccessEntry, addr string, err error) {
+	if err != nil {
+		o.add("dial failed")
+	} else {
+		o.add("dialed")
+	}
+}
+func (o *recordObserver) Transferred(e *AccessEntry, up, down int64) {
+	o.mu.Lock()
+	o.up += up
+	o.down += down
+	o.mu.Unlock()
+}
+func (o *recordObserver) Closed(e *AccessEntry) {
+	o.add("closed")
+	o.closed <- *e
+}
+func (o *recordObserver) UDPSessionCreated(e *AccessEntry) { o.add("udp created") }
+func (o *recordObserver) UDPSessionExpired(e *AccessEntry) {
+	o.add("udp expired")
+	o.closed <- *e
+}
+
+func (o *recordObserver) check(t *testing.T, want ...string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.events) != len(want) {
+		t.Fatalf("events %q, want %q", o.events, want)
+	}
+	for i := range want {
+		if o.events[i] != want[i] {
+			t.Fatalf("events %q, want %q", o.events, want)
+		}
+	}
+}
+
+func waitClosed(t *testing.T, o *recordObserver) AccessEntry {
+	select {
+	case e := <-o.closed:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	return AccessEntry{}
+}
+
+func TestServerObserver(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newRecordObserver()
+	srv := NewServer(cipher)
+	srv.Observer = obs
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	target := echo.Addr().String()
+	c, err := Dial(target, ln.Addr().String(), cipher.Copy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	checkEcho(t, c)
+	c.Close()
+
+	e := waitClosed(t, obs)
+	obs.check(t, "accepted", "handshake "+target, "dialed", "closed")
+	if e.BytesUp != 5 || e.BytesDown != 5 {
+		t.Errorf("closed with %d bytes up %d down, want 5 5", e.BytesUp, e.BytesDown)
+	}
+	if obs.up != e.BytesUp || obs.down != e.BytesDown {
+		t.Errorf("transferred %d up %d down, closed with %d %d", obs.up, obs.down, e.BytesUp, e.BytesDown)
+	}
+	if e.Reason != CloseEOF {
+		t.Errorf("close reason %s", e.Reason)
+	}
+}
+
+func TestServerObserverUDP(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newRecordObserver()
+	srv := NewServer(cipher)
+	srv.Observer = obs
+	srv.UDPTimeout = 100 * time.Millisecond
+	go srv.ServePacket(pc)
+	defer srv.Close()
+
+	d, err := NewDialer(pc.LocalAddr().String(), cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.ListenPacket("udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.WriteTo([]byte("ping"), echo.LocalAddr())
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err = c.ReadFrom(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+
+	e := waitClosed(t, obs)
+	obs.check(t, "udp created", "udp expired")
+	if e.BytesUp != 4 || e.BytesDown != 4 {
+		t.Errorf("expired with %d bytes up %d down, want 4 4", e.BytesUp, e.BytesDown)
+	}
+	if e.Target != echo.LocalAddr().String() {
+		t.Errorf("session target %s, want %s", e.Target, echo.LocalAddr())
+	}
+}
+
+func TestLocalObserver(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newRecordObserver()
+	dead := &Upstream{Server: unusedAddr(t), Cipher: cipher}
+	l := NewLocal([]*Upstream{dead, {Server: srvAddr, Cipher: cipher}}, nil)
+	l.Observer = obs
+	go l.Serve(ln)
+	defer l.Close()
+	addr := ln.Addr().String()
+
+	target := echo.Addr().String()
+	c := socksConnect(t, addr, target, nil)
+	checkEcho(t, c)
+	c.Close()
+
+	e := waitClosed(t, obs)
+	obs.check(t, "accepted", "handshake "+target, "dial failed", "dialed", "closed")
+	if e.BytesUp != 5 || e.BytesDown != 5 {
+		t.Errorf("closed with %d bytes up %d down, want 5 5", e.BytesUp, e.BytesDown)
+	}
+}
@@ -0,0 +1,309 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ParseDomainList reads a list of domains, one per line, and returns the
+// DOMAIN-SUFFIX rules matching them and their subdomains with action. Empty
+// lines and lines starting with # are ignored.
+func ParseDomainList(rd io.Reader, action RuleAction) ([]*Rule, error) {
+	var rules []*Rule
+	scanner := bufio.NewScanner(rd)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		r, err := parseRule("DOMAIN-SUFFIX,"+line+","+action.String(), lineno)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// gfwListHost returns the host of a gfwlist URL pattern, without the leading
+// wildcard, or the empty string if the pattern has no usable host.
+func gfwListHost(pattern string) string {
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		pattern = pattern[i+3:]
+	}
+	host := pattern
+	if i := strings.IndexAny(host, "/?"); i >= 0 {
+		host = host[:i]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(strings.Trim(host, "."), "*.")
+	if host == "" || strings.ContainsAny(host, "*%, \t") {
+		return ""
+	}
+	return strings.ToLower(host)
+}
+
+// ParseGFWList reads a list in the gfwlist format, which is the AdBlock
+// syntax encoded in base64, the decoded list is accepted too. The hosts of
+// the patterns are proxied, and those of the exceptions (@@) are connected
+// directly, the exception rules come first. Regular expressions and patterns
+// without a plain host are ignored.
+func ParseGFWList(rd io.Reader) ([]*Rule, error) {
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	if b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), "")); err == nil {
+		data = b
+	}
+	var direct, proxy []*Rule
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		// comments and the [AutoProxy x.y] header
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		action := ActionProxy
+		if strings.HasPrefix(line, "@@") {
+			action = ActionDirect
+			line = line[2:]
+		}
+		if len(line) > 1 && line[0] == '/' && line[len(line)-1] == '/' {
+			continue
+		}
+		host := gfwListHost(strings.TrimLeft(line, "|."))
+		if host == "" {
+			continue
+		}
+		rule := "DOMAIN-SUFFIX," + host
+		if ip := net.ParseIP(host); ip != nil {
+			if ip.To4() != nil {
+				rule = "IP-CIDR," + host + "/32"
+			} else {
+				rule = "IP-CIDR," + host + "/128"
+			}
+		}
+		rule += "," + action.String()
+		if seen[rule] {
+			continue
+		}
+		seen[rule] = true
+		r, err := parseRule(rule, lineno)
+		if err != nil {
+			continue
+		}
+		if action == ActionDirect {
+			direct = append(direct, r)
+		} else {
+			proxy = append(proxy, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return append(direct, proxy...), nil
+}
+
+// pacEntry returns the rule as a javascript array, see pacScript.
+func pacEntry(r *Rule) []interface{} {
+	switch r.Type {
+	case "IP-CIDR":
+		ip4 := r.ipnet.IP.To4()
+		if ip4 == nil {
+			return []interface{}{"IP6", ActionProxy.String()}
+		}
+		lo := binary.BigEndian.Uint32(ip4)
+		hi := lo | ^binary.BigEndian.Uint32(net.IP(r.ipnet.Mask).To4())
+		return []interface{}{r.Type, r.Action.String(), lo, hi}
+	case "DST-PORT":
+		return []interface{}{r.Type, r.Action.String(), r.lo, r.hi}
+	case "DOMAIN", "DOMAIN-SUFFIX", "DOMAIN-KEYWORD", "DOMAIN-REGEX":
+		return []interface{}{r.Type, r.Action.String(), r.Value}
+	case "MATCH":
+		return []interface{}{r.Type, r.Action.String()}
+	}
+	// GEOIP
+	return []interface{}{"LOCAL", ActionProxy.String()}
+}
+
+// pacScript is the end of the PAC file, evaluating the rules array written
+// by PACHandler. Targets reaching a LOCAL entry, for rules browsers can't
+// evaluate, are sent to the local proxy, which routes them with the same
+// rules. So are IPv6 addresses reaching an IP6 entry.
+const pacScript = `
+function pacIP4(s) {
+	var m = /^(\d+)\.(\d+)\.(\d+)\.(\d+)$/.exec(s);
+	if (!m) {
+		return -1;
+	}
+	return ((+m[1] * 256 + +m[2]) * 256 + +m[3]) * 256 + +m[4];
+}
+
+function pacPort(url) {
+	var m = /^([a-z0-9+.-]+):\/\/[^\/]*?(?::(\d+))?(?:[\/?#]|$)/i.exec(url);
+	if (!m) {
+		return 0;
+	}
+	if (m[2]) {
+		return +m[2];
+	}
+	return {http: 80, ws: 80, https: 443, wss: 443, ftp: 21}[m[1].toLowerCase()] || 0;
+}
+
+for (var i = 0; i < rules.length; i++) {
+	if (rules[i][0] == "DOMAIN-REGEX") {
+		try {
+			rules[i][2] = new RegExp(rules[i][2]);
+		} catch (e) {
+			// not a javascript regular expression, leave the domain
+			// names to the local proxy
+			rules[i] = ["DOMAIN-REGEX", "PROXY", null];
+		}
+	}
+}
+
+function pacMatch(r, host, ip, port) {
+	var domain = ip < 0 && host.indexOf(":") < 0;
+	switch (r[0]) {
+	case "DOMAIN":
+		return domain && host == r[2];
+	case "DOMAIN-SUFFIX":
+		return domain && (host == r[2] ||
+			(host.length > r[2].length && host.slice(-r[2].length - 1) == "." + r[2]));
+	case "DOMAIN-KEYWORD":
+		return domain && host.indexOf(r[2]) >= 0;
+	case "DOMAIN-REGEX":
+		return domain && (!r[2] || r[2].test(host));
+	case "IP-CIDR":
+		return r[2] <= ip && ip <= r[3];
+	case "DST-PORT":
+		return r[2] <= port && port <= r[3];
+	case "IP6":
+		return host.indexOf(":") >= 0;
+	}
+	// MATCH and LOCAL
+	return true;
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase().replace(/^\[|\]$/g, "").replace(/\.$/, "");
+	var ip = pacIP4(host), port = pacPort(url);
+	for (var i = 0; i < rules.length; i++) {
+		if (pacMatch(rules[i], host, ip, port)) {
+			switch (rules[i][1]) {
+			case "DIRECT":
+				return "DIRECT";
+			case "REJECT":
+				return reject;
+			}
+			return proxy;
+		}
+	}
+	return proxy;
+}
+`
+
+// PACHandler is the http.Handler serving the proxy auto-config file made of
+// the rules, for any path. Browsers are told to use the proxies on the host
+// they got the file from, falling back to DIRECT if the proxies are down.
+//
+// Rejected targets are sent to the proxies, which reject them if they use the
+// same rules.
+type PACHandler struct {
+	// SOCKSPort and HTTPPort are the ports of the SOCKS5 and HTTP proxies,
+	// 0 if not served.
+	SOCKSPort int
+	HTTPPort  int
+
+	mu    sync.RWMutex
+	rules []byte // javascript array
+}
+
+// SetRules replaces the rules of the file.
+func (h *PACHandler) SetRules(rules []*Rule) {
+	var buf bytes.Buffer
+	buf.WriteString("var rules = [")
+	for i, r := range rules {
+		// no trailing comma, old engines add an undefined element
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		b, _ := json.Marshal(pacEntry(r))
+		buf.WriteByte('\n')
+		buf.Write(b)
+	}
+	buf.WriteString("\n];\n")
+	h.mu.Lock()
+	h.rules = buf.Bytes()
+	h.mu.Unlock()
+}
+
+// proxies returns the PAC result using the proxies on host.
+func (h *PACHandler) proxies(host string) string {
+	var p []string
+	if h.SOCKSPort != 0 {
+		p = append(p, "SOCKS5 "+net.JoinHostPort(host, strconv.Itoa(h.SOCKSPort)))
+	}
+	if h.HTTPPort != 0 {
+		p = append(p, "PROXY "+net.JoinHostPort(host, strconv.Itoa(h.HTTPPort)))
+	}
+	return strings.Join(p, "; ")
+}
+
+func (h *PACHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	proxies := h.proxies(host)
+	h.mu.RLock()
+	rules := h.rules
+	h.mu.RUnlock()
+
+	var buf bytes.Buffer
+	buf.WriteString("// proxy auto-config generated by shadowsocks-local\n")
+	p, _ := json.Marshal(proxies + "; DIRECT")
+	fmt.Fprintf(&buf, "var proxy = %s;\n", p)
+	p, _ = json.Marshal(proxies)
+	fmt.Fprintf(&buf, "var reject = %s;\n", p)
+	if rules == nil {
+		rules = []byte("var rules = [];\n")
+	}
+	buf.Write(rules)
+	buf.WriteString(pacScript)
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
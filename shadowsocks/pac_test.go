@@ -0,0 +1,125 @@
+package shadowsocks
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseGFWList(t *testing.T) {
+	list := `[AutoProxy 0.2.9]
+! comment
+||blocked.example
+|https://www.blocked.example/path
+.Other.example
+plain.example/some/path
+|http://203.0.113.7:8080/
+/^https?:\/\/[^\/]+regex\.example/
+*.wild.example
+@@||cn.blocked.example
+||blocked.example
+`
+	want := []string{
+		"line 10 DOMAIN-SUFFIX,cn.blocked.example,DIRECT",
+		"line 3 DOMAIN-SUFFIX,blocked.example,PROXY",
+		"line 4 DOMAIN-SUFFIX,www.blocked.example,PROXY",
+		"line 5 DOMAIN-SUFFIX,other.example,PROXY",
+		"line 6 DOMAIN-SUFFIX,plain.example,PROXY",
+		"line 7 IP-CIDR,203.0.113.7/32,PROXY",
+		"line 9 DOMAIN-SUFFIX,wild.example,PROXY",
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(list))
+	// gfwlist wraps lines at 64 characters
+	var wrapped []string
+	for len(encoded) > 64 {
+		wrapped = append(wrapped, encoded[:64])
+		encoded = encoded[64:]
+	}
+	wrapped = append(wrapped, encoded)
+	for _, input := range []string{strings.Join(wrapped, "\n"), list} {
+		rules, err := ParseGFWList(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range rules {
+			got = append(got, r.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("got rules:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestParseDomainList(t *testing.T) {
+	rules, err := ParseDomainList(strings.NewReader("# intranet\nCorp.example\n\n.lan\n"), ActionDirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].String() != "line 2 DOMAIN-SUFFIX,corp.example,DIRECT" ||
+		rules[1].String() != "line 4 DOMAIN-SUFFIX,lan,DIRECT" {
+		t.Errorf("got rules %v", rules)
+	}
+	if _, err = ParseDomainList(strings.NewReader("a.example,b.example"), ActionDirect); err == nil {
+		t.Error("domain with comma accepted")
+	}
+}
+
+func TestPACHandler(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+DOMAIN-SUFFIX,cn.example,DIRECT
+DOMAIN,ads.example,REJECT
+IP-CIDR,10.0.0.0/8,DIRECT
+IP-CIDR,fd00::/8,DIRECT
+DST-PORT,25,REJECT
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &PACHandler{SOCKSPort: 1080, HTTPPort: 8118}
+	h.SetRules(rules)
+
+	req := httptest.NewRequest("GET", "http://192.0.2.1:8090/proxy.pac", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ns-proxy-autoconfig" {
+		t.Errorf("got content type %q", ct)
+	}
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, s := range []string{
+		`var proxy = "SOCKS5 192.0.2.1:1080; PROXY 192.0.2.1:8118; DIRECT";`,
+		`var reject = "SOCKS5 192.0.2.1:1080; PROXY 192.0.2.1:8118";`,
+		`["DOMAIN-SUFFIX","DIRECT","cn.example"],`,
+		`["DOMAIN","REJECT","ads.example"],`,
+		`["IP-CIDR","DIRECT",167772160,184549375],`,
+		`["IP6","PROXY"],`,
+		`["DST-PORT","REJECT",25,25]` + "\n];",
+		"function FindProxyForURL(url, host)",
+	} {
+		if !strings.Contains(string(body), s) {
+			t.Errorf("PAC file doesn't contain %s:\n%s", s, body)
+		}
+	}
+
+	h.SetRules(nil)
+	req = httptest.NewRequest("GET", "http://[::1]/", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	body, _ = ioutil.ReadAll(w.Body)
+	if !strings.Contains(string(body), `var proxy = "SOCKS5 [::1]:1080; PROXY [::1]:8118; DIRECT";`) ||
+		!strings.Contains(string(body), "var rules = [\n];") {
+		t.Errorf("got PAC file:\n%s", body)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST got status %d", w.Code)
+	}
+}
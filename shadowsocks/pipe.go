@@ -9,25 +9,45 @@ import (
 )
 
 func SetReadTimeout(c net.Conn) {
-	if readTimeout != 0 {
-		c.SetReadDeadline(time.Now().Add(readTimeout))
+	setReadTimeout(c, readTimeout)
+}
+
+func setReadTimeout(c net.Conn, timeout time.Duration) {
+	if timeout != 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
 	}
 }
 
 // PipeThenClose copies data from src to dst, closes dst when done.
 func PipeThenClose(src, dst net.Conn) {
+	pipeThenClose(src, dst, readTimeout, nil, 0, nil)
+}
+
+// pipeThenClose is PipeThenClose with the given read timeout, returning the
+// number of bytes written to dst and the error that ended the copy. Errors
+// are logged to lg, the package logger if nil, with the connection id if not
+// 0. If count is not nil, it's called with the number of bytes after each
+// write.
+func pipeThenClose(src, dst net.Conn, timeout time.Duration, lg Logger, id uint64, count func(n int64)) (written int64, err error) {
 	defer dst.Close()
 	buf := leakyBuf.Get()
 	defer leakyBuf.Put(buf)
 	for {
-		SetReadTimeout(src)
-		n, err := src.Read(buf)
+		setReadTimeout(src, timeout)
+		var n int
+		n, err = src.Read(buf)
 		// read may return EOF with n > 0
 		// should always process n > 0 bytes before handling error
 		if n > 0 {
 			// Note: avoid overwrite err returned by Read.
-			if _, err := dst.Write(buf[0:n]); err != nil {
-				Debug.Println("write:", err)
+			nw, werr := dst.Write(buf[0:n])
+			written += int64(nw)
+			if count != nil && nw > 0 {
+				count(int64(nw))
+			}
+			if werr != nil {
+				pipeLog(lg, id, "pipe write error", F(KeyError, werr))
+				err = werr
 				break
 			}
 		}
@@ -36,17 +56,24 @@ func PipeThenClose(src, dst net.Conn) {
 			// identify this specific error. So just leave the error along for now.
 			// More info here: https://code.google.com/p/go/issues/detail?id=4373
 			/*
-				if bool(Debug) && err != io.EOF {
-					Debug.Println("read:", err)
+				if err != io.EOF {
+					pipeLog(lg, id, "pipe read error", F(KeyError, err))
 				}
 			*/
 			break
 		}
 	}
+	return
 }
 
 // PipeThenClose copies data from src to dst, closes dst when done, with ota verification.
 func PipeThenCloseOta(src *Conn, dst net.Conn) {
+	pipeThenCloseOta(src, dst, readTimeout, nil, 0, nil)
+}
+
+// pipeThenCloseOta is PipeThenCloseOta with the arguments and results of
+// pipeThenClose. The error is ErrOTAFailed if a chunk fails verification.
+func pipeThenCloseOta(src *Conn, dst net.Conn, timeout time.Duration, lg Logger, id uint64, count func(n int64)) (written int64, err error) {
 	const (
 		dataLenLen  = 2
 		hmacSha1Len = 10
@@ -60,12 +87,13 @@ func PipeThenCloseOta(src *Conn, dst net.Conn) {
 	buf := leakyBuf.Get()
 	defer leakyBuf.Put(buf)
 	for i := 1; ; i += 1 {
-		SetReadTimeout(src)
-		if n, err := io.ReadFull(src, buf[:dataLenLen+hmacSha1Len]); err != nil {
+		setReadTimeout(src, timeout)
+		var n int
+		if n, err = io.ReadFull(src, buf[:dataLenLen+hmacSha1Len]); err != nil {
 			if err == io.EOF {
 				break
 			}
-			Debug.Printf("conn=%p #%v read header error n=%v: %v", src, i, n, err)
+			pipeLog(lg, id, "ota read header error", F("chunk", i), F(KeyBytes, n), F(KeyError, err))
 			break
 		}
 		dataLen := binary.BigEndian.Uint16(buf[:dataLenLen])
@@ -77,11 +105,11 @@ func PipeThenCloseOta(src *Conn, dst net.Conn) {
 		} else {
 			dataBuf = buf[idxData0 : idxData0+dataLen]
 		}
-		if n, err := io.ReadFull(src, dataBuf); err != nil {
+		if n, err = io.ReadFull(src, dataBuf); err != nil {
 			if err == io.EOF {
 				break
 			}
-			Debug.Printf("conn=%p #%v read data error n=%v: %v", src, i, n, err)
+			pipeLog(lg, id, "ota read data error", F("chunk", i), F(KeyBytes, n), F(KeyError, err))
 			break
 		}
 		chunkIdBytes := make([]byte, 4)
@@ -89,12 +117,33 @@ func PipeThenCloseOta(src *Conn, dst net.Conn) {
 		binary.BigEndian.PutUint32(chunkIdBytes, chunkId)
 		actualHmacSha1 := HmacSha1(append(src.GetIv(), chunkIdBytes...), dataBuf)
 		if !bytes.Equal(expectedHmacSha1, actualHmacSha1) {
-			Debug.Printf("conn=%p #%v read data hmac-sha1 mismatch, iv=%v chunkId=%v src=%v dst=%v len=%v expeced=%v actual=%v", src, i, src.GetIv(), chunkId, src.RemoteAddr(), dst.RemoteAddr(), dataLen, expectedHmacSha1, actualHmacSha1)
+			pipeLog(lg, id, "ota data hmac-sha1 mismatch", F("chunk", i), F("chunk_id", chunkId),
+				F(KeyClient, src.RemoteAddr()), F(KeyTarget, dst.RemoteAddr()), F(KeyBytes, dataLen))
+			err = ErrOTAFailed
 			break
 		}
-		if n, err := dst.Write(dataBuf); err != nil {
-			Debug.Printf("conn=%p #%v write data error n=%v: %v", dst, i, n, err)
+		n, err = dst.Write(dataBuf)
+		written += int64(n)
+		if count != nil && n > 0 {
+			count(int64(n))
+		}
+		if err != nil {
+			pipeLog(lg, id, "ota write data error", F("chunk", i), F(KeyBytes, n), F(KeyError, err))
 			break
 		}
 	}
+	return
+}
+
+// pipeLog writes a debug entry about a pipe to lg, or the package logger if
+// nil.
+func pipeLog(lg Logger, id uint64, msg string, fields ...Field) {
+	lg = loggerOr(lg)
+	if !lg.Enabled(LevelDebug) {
+		return
+	}
+	if id != 0 {
+		fields = append([]Field{F(KeyConnID, id)}, fields...)
+	}
+	lg.Log(LevelDebug, msg, fields...)
 }
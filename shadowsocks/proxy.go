@@ -1,19 +1,30 @@
 package shadowsocks
 
 import (
+	"context"
 	"errors"
 	"strings"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"time"
+
+	"golang.org/x/net/proxy"
 )
 
 type Dialer struct {
 	cipher *Cipher
 	server string
 	support_udp bool
+
+	// Timeout is the maximum amount of time a dial will wait for the
+	// connection to the server being established. Zero means no timeout.
+	Timeout time.Duration
 }
 
+var _ proxy.ContextDialer = (*Dialer)(nil)
+
 type ProxyConn struct {
 	*Conn
 	raddr *ProxyAddr
@@ -27,20 +38,30 @@ type ProxyAddr struct {
 var ErrNilCipher = errors.New("cipher can't be nil.")
 
 func NewDialer(server string, cipher *Cipher) (dialer *Dialer, err error) {
-	// Currently shadowsocks-go do not support UDP
 	if cipher == nil {
 		return nil, ErrNilCipher
 	}
 	return &Dialer {
 		cipher: cipher,
 		server: server,
-		support_udp: false,
+		support_udp: true,
 	}, nil
 }
 
 func (d *Dialer) Dial(network, addr string) (c net.Conn, err error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the shadowsocks server. ctx can abort
+// connecting to the server and sending the request header.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (c net.Conn, err error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
 	if strings.HasPrefix(network, "tcp") {
-		conn, err := Dial(addr, d.server, d.cipher.Copy())
+		conn, err := DialContext(ctx, addr, d.server, d.cipher.Copy())
 		if err != nil {
 			return nil, err
 		}
@@ -52,9 +73,129 @@ func (d *Dialer) Dial(network, addr string) (c net.Conn, err error) {
 			},
 		}, nil
 	}
+	if strings.HasPrefix(network, "udp") && d.support_udp {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pc, err := d.ListenPacket(network, "")
+		if err != nil {
+			return nil, err
+		}
+		return &proxyUDPConn{
+			ProxyPacketConn: pc.(*ProxyPacketConn),
+			raddr: &ProxyAddr{
+				network: network,
+				address: addr,
+			},
+		}, nil
+	}
 	return nil, fmt.Errorf("unsupported connection type: %s", network)
 }
 
+// ListenPacket returns a net.PacketConn whose packets are relayed by the
+// shadowsocks server. WriteTo sends a packet to the given destination
+// address, and ReadFrom returns the address of the remote host sending the
+// packet. laddr is the local address to listen on, it's usually empty.
+func (d *Dialer) ListenPacket(network, laddr string) (net.PacketConn, error) {
+	if !strings.HasPrefix(network, "udp") {
+		return nil, fmt.Errorf("unsupported packet connection type: %s", network)
+	}
+	server, err := net.ResolveUDPAddr(network, d.server)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.ListenPacket(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyPacketConn{
+		SecurePacketConn: NewSecurePacketConn(c, d.cipher.Copy(), d.cipher.ota),
+		server:           server,
+	}, nil
+}
+
+// ProxyPacketConn is a packet connection relayed by a shadowsocks server.
+type ProxyPacketConn struct {
+	*SecurePacketConn
+	server net.Addr
+}
+
+// WriteTo encapsulates the destination address in the shadowsocks UDP
+// request and sends the encrypted packet to the server.
+func (c *ProxyPacketConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	header, err := rawAddrOf(addr)
+	if err != nil {
+		return
+	}
+	buf := make([]byte, len(header)+len(b), len(header)+len(b)+lenHmacSha1)
+	copy(buf, header)
+	copy(buf[len(header):], b)
+	if _, err = c.SecurePacketConn.WriteTo(buf, c.server); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads a packet relayed by the server, the address returned is
+// the one of the remote host sending the packet. Packets not coming from the
+// server are dropped. If b is too small for the packet, it's filled and
+// io.ErrShortBuffer is returned.
+func (c *ProxyPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	buf := udpBuf.Get()
+	defer udpBuf.Put(buf)
+	for {
+		var src net.Addr
+		n, src, err = c.SecurePacketConn.ReadFrom(buf)
+		if err != nil {
+			if _, ok := err.(net.Error); ok {
+				return 0, nil, err
+			}
+			// drop invalid packet
+			Log(LevelDebug, "dropped invalid udp packet", F(KeyServer, c.server), F(KeyError, err))
+			continue
+		}
+		if src.String() != c.server.String() {
+			continue
+		}
+		buf[idType] &= AddrMask
+		host, port, hlen, perr := parseRawAddr(buf[:n])
+		if perr != nil {
+			Log(LevelDebug, "dropped invalid udp packet", F(KeyServer, c.server), F(KeyError, perr))
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			addr = &net.UDPAddr{IP: ip, Port: port}
+		} else {
+			addr = &ProxyAddr{network: "udp", address: net.JoinHostPort(host, strconv.Itoa(port))}
+		}
+		payload := buf[hlen:n]
+		if n = copy(b, payload); n < len(payload) {
+			err = io.ErrShortBuffer
+		}
+		return
+	}
+}
+
+// proxyUDPConn is returned by Dial for udp networks, it's a packet connection
+// with fixed destination.
+type proxyUDPConn struct {
+	*ProxyPacketConn
+	raddr *ProxyAddr
+}
+
+func (c *proxyUDPConn) Read(b []byte) (n int, err error) {
+	n, _, err = c.ReadFrom(b)
+	return
+}
+
+func (c *proxyUDPConn) Write(b []byte) (n int, err error) {
+	return c.WriteTo(b, c.raddr)
+}
+
+func (c *proxyUDPConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
 func (c *ProxyConn) LocalAddr() net.Addr {
 	return c.Conn.LocalAddr()
 }
@@ -0,0 +1,249 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUDPEcho starts a UDP server replying with the packets it receives.
+func startUDPEcho(t *testing.T) net.PacketConn {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	return echo
+}
+
+// startUDPRelay starts a shadowsocks UDP relay server.
+func startUDPRelay(t *testing.T, cipher *Cipher) net.PacketConn {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := NewSecurePacketConn(c, cipher.Copy(), false)
+	go func() {
+		for {
+			if err := ReadAndHandleUDPReq(relay); err != nil {
+				if _, ok := err.(net.Error); ok {
+					return
+				}
+			}
+		}
+	}()
+	return c
+}
+
+func TestDialerListenPacket(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	relay := startUDPRelay(t, cipher)
+	defer relay.Close()
+
+	d, err := NewDialer(relay.LocalAddr().String(), cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := d.ListenPacket("udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	msg := []byte("hello through the relay")
+	if n, err := pc.WriteTo(msg, echo.LocalAddr()); err != nil || n != len(msg) {
+		t.Fatalf("WriteTo: n=%d err=%v", n, err)
+	}
+	buf := make([]byte, 2048)
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("ReadFrom:", err)
+	}
+	if string(buf[:n]) != string(msg) {
+		t.Errorf("got %q, want %q", buf[:n], msg)
+	}
+	if addr.String() != echo.LocalAddr().String() {
+		t.Errorf("source address %v, want %v", addr, echo.LocalAddr())
+	}
+}
+
+func TestProxyPacketConnLargePacket(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	server := NewSecurePacketConn(c, cipher.Copy(), false)
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}
+	header, err := rawAddrOf(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, 10000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	// replies to each packet with a large one
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			_, src, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(append(append([]byte(nil), header...), payload...), src)
+		}
+	}()
+
+	d, err := NewDialer(c.LocalAddr().String(), cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := d.ListenPacket("udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	pc.WriteTo([]byte("ping"), target)
+	buf := make([]byte, maxUDPPacketSize)
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil || n != len(payload) || !bytes.Equal(buf[:n], payload) {
+		t.Errorf("ReadFrom got %d bytes, error %v, want %d", n, err, len(payload))
+	}
+	if addr.String() != target.String() {
+		t.Errorf("source address %v, want %v", addr, target)
+	}
+
+	pc.WriteTo([]byte("ping"), target)
+	n, _, err = pc.ReadFrom(buf[:100])
+	if err != io.ErrShortBuffer || n != 100 || !bytes.Equal(buf[:n], payload[:100]) {
+		t.Errorf("ReadFrom with a short buffer got %d bytes, error %v", n, err)
+	}
+}
+
+func TestDialerDialUDP(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	relay := startUDPRelay(t, cipher)
+	defer relay.Close()
+
+	d, err := NewDialer(relay.LocalAddr().String(), cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Dial("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("Read got %q %v", buf[:n], err)
+	}
+	if c.RemoteAddr().String() != echo.LocalAddr().String() {
+		t.Errorf("wrong remote address %v", c.RemoteAddr())
+	}
+}
+
+func TestDialerDialContext(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	reqs := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c := NewConn(conn, cipher.Copy())
+			buf := make([]byte, 64)
+			n, _ := c.Read(buf)
+			reqs <- buf[:n]
+			// echo the data following the request
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	d, err := NewDialer(ln.Addr().String(), cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Timeout = 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.DialContext(ctx, "tcp", "example.com:80"); err == nil {
+		t.Error("dial with canceled context should fail")
+	}
+
+	// the deadline of ctx is used for the header only
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c, err := d.DialContext(ctx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	expect, _ := RawAddr("example.com:80")
+	select {
+	case req := <-reqs:
+		if string(req) != string(expect) {
+			t.Errorf("server got request %v, want %v", req, expect)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't get the request")
+	}
+	// the deadline used for the header must have been cleared
+	<-ctx.Done()
+	time.Sleep(50 * time.Millisecond)
+	if _, err = c.Write([]byte("ping")); err != nil {
+		t.Fatal("write after the dial deadline:", err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("read after the dial deadline got %q, error %v", buf, err)
+	}
+}
@@ -0,0 +1,42 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errRedirUnsupported = errors.New("transparent proxy is not supported on this platform")
+
+// originalDst returns the destination of a connection redirected by the
+// firewall. It's a variable so tests can replace it.
+var originalDst = getOriginalDst
+
+// RedirHandler is the InboundHandler serving connections redirected by
+// iptables REDIRECT, the target is the original destination of the
+// connection. Only supported on Linux.
+type RedirHandler struct{}
+
+func (h *RedirHandler) ServeInbound(ctx context.Context, conn net.Conn, l *Local) {
+	lg := l.logger()
+	id := accessEntry(ctx).ConnID
+	dst, err := originalDst(conn)
+	if err != nil {
+		lg.Log(LevelWarn, "error getting original destination", F(KeyConnID, id),
+			F(KeyClient, conn.RemoteAddr()), F(KeyError, err))
+		return
+	}
+	rawaddr, err := rawAddrOf(dst)
+	if err != nil {
+		lg.Log(LevelWarn, "error getting original destination", F(KeyConnID, id),
+			F(KeyClient, conn.RemoteAddr()), F(KeyError, err))
+		return
+	}
+	addr := dst.String()
+	l.Handshake(ctx, addr, "")
+	remote, err := l.Connect(ctx, rawaddr, addr)
+	if err != nil {
+		return
+	}
+	l.Relay(ctx, conn, remote)
+}
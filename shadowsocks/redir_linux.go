@@ -0,0 +1,56 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST in linux/netfilter_ipv4.h
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST in linux/netfilter_ipv6/ip6_tables.h
+)
+
+// getOriginalDst gets the original destination of conn with SO_ORIGINAL_DST,
+// or IP6T_SO_ORIGINAL_DST for IPv6 connections.
+func getOriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errRedirUnsupported
+	}
+	f, err := tc.File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+	// File puts the socket, shared with conn, in blocking mode
+	defer syscall.SetNonblock(fd, true)
+
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	if local == nil || local.IP.To4() != nil {
+		// The syscall package has no getsockopt for sockaddr, borrow
+		// functions getting structures large enough to hold one.
+		// sockaddr_in: family, port, addr
+		mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			return nil, err
+		}
+		b := mreq.Multiaddr[:]
+		return &net.TCPAddr{
+			IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+			Port: int(binary.BigEndian.Uint16(b[2:4])),
+		}, nil
+	}
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.IPPROTO_IPV6, ip6tSoOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	// the port is in network byte order
+	port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+	return &net.TCPAddr{
+		IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+		Port: int(binary.BigEndian.Uint16(port[:])),
+	}, nil
+}
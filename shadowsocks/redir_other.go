@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import "net"
+
+func getOriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errRedirUnsupported
+}
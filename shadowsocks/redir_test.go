@@ -0,0 +1,66 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRedirHandler(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+
+	// pretend all connections were redirected from the echo server
+	defer func(f func(net.Conn) (*net.TCPAddr, error)) { originalDst = f }(originalDst)
+	originalDst = func(net.Conn) (*net.TCPAddr, error) {
+		return echo.Addr().(*net.TCPAddr), nil
+	}
+	obs := newRecordObserver()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLocal([]*Upstream{{Server: srvAddr, Cipher: cipher}}, &RedirHandler{})
+	l.Observer = obs
+	go l.Serve(ln)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	checkEcho(t, c)
+	c.Close()
+	waitClosed(t, obs)
+	obs.check(t, "accepted", "handshake "+echo.Addr().String(), "dialed", "closed")
+}
+
+func TestGetOriginalDstNotRedirected(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if dst, err := getOriginalDst(c); err == nil {
+		t.Errorf("got original destination %v of a connection not redirected", dst)
+	}
+	// the connection is still usable, with deadlines
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("read without data succeeded")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("read error %v, want a timeout", err)
+	}
+}
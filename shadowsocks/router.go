@@ -0,0 +1,283 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errRejected = errors.New("shadowsocks: connection rejected by rule")
+
+// RuleAction tells what to do with the connections matching a rule.
+type RuleAction int
+
+const (
+	// ActionProxy relays the connection through the shadowsocks servers.
+	ActionProxy RuleAction = iota
+	// ActionDirect connects to the target directly.
+	ActionDirect
+	// ActionReject closes the connection.
+	ActionReject
+)
+
+func (a RuleAction) String() string {
+	switch a {
+	case ActionDirect:
+		return "DIRECT"
+	case ActionReject:
+		return "REJECT"
+	}
+	return "PROXY"
+}
+
+// Rule is a routing rule, see ParseRules for the syntax.
+type Rule struct {
+	Type   string // DOMAIN, DOMAIN-SUFFIX, IP-CIDR, GEOIP, MATCH...
+	Value  string
+	Action RuleAction
+	// Group is the server group used by ActionProxy, all servers are used
+	// if empty.
+	Group string
+	Line  int // line number in the rule file
+
+	re     *regexp.Regexp
+	ipnet  *net.IPNet
+	lo, hi int // port range
+}
+
+func (r *Rule) String() string {
+	action := r.Action.String()
+	if r.Group != "" {
+		action += ":" + r.Group
+	}
+	if r.Type == "MATCH" {
+		return fmt.Sprintf("line %d MATCH,%s", r.Line, action)
+	}
+	return fmt.Sprintf("line %d %s,%s,%s", r.Line, r.Type, r.Value, action)
+}
+
+// match reports whether the rule matches host, which is a lower case domain
+// name or an IP address, and port. GEOIP rules are matched by Router.
+func (r *Rule) match(host string, ip net.IP, port int) bool {
+	switch r.Type {
+	case "DOMAIN":
+		return ip == nil && host == r.Value
+	case "DOMAIN-SUFFIX":
+		return ip == nil && (host == r.Value || strings.HasSuffix(host, "."+r.Value))
+	case "DOMAIN-KEYWORD":
+		return ip == nil && strings.Contains(host, r.Value)
+	case "DOMAIN-REGEX":
+		return ip == nil && r.re.MatchString(host)
+	case "IP-CIDR":
+		// domain names are not resolved
+		return ip != nil && r.ipnet.Contains(ip)
+	case "DST-PORT":
+		return r.lo <= port && port <= r.hi
+	case "MATCH":
+		return true
+	}
+	return false
+}
+
+// parseRule parses a line of the rule file.
+func parseRule(line string, lineno int) (*Rule, error) {
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	r := &Rule{Type: strings.ToUpper(fields[0]), Line: lineno}
+	if r.Type == "FINAL" {
+		r.Type = "MATCH"
+	}
+	var action string
+	switch {
+	case r.Type == "MATCH" && len(fields) == 2:
+		action = fields[1]
+	case r.Type != "MATCH" && len(fields) == 3:
+		r.Value, action = fields[1], fields[2]
+	default:
+		return nil, fmt.Errorf("rule line %d: wrong number of fields", lineno)
+	}
+	action = strings.TrimSpace(action)
+	if i := strings.IndexByte(action, ':'); i >= 0 {
+		action, r.Group = action[:i], action[i+1:]
+	}
+	switch strings.ToUpper(action) {
+	case "PROXY":
+		r.Action = ActionProxy
+	case "DIRECT":
+		r.Action = ActionDirect
+	case "REJECT":
+		r.Action = ActionReject
+	default:
+		return nil, fmt.Errorf("rule line %d: unknown action %s", lineno, action)
+	}
+	if r.Group != "" && r.Action != ActionProxy {
+		return nil, fmt.Errorf("rule line %d: server group with %s action", lineno, r.Action)
+	}
+
+	var err error
+	switch r.Type {
+	case "DOMAIN", "DOMAIN-SUFFIX", "DOMAIN-KEYWORD":
+		r.Value = strings.ToLower(strings.Trim(r.Value, "."))
+	case "DOMAIN-REGEX":
+		r.re, err = regexp.Compile(r.Value)
+	case "IP-CIDR", "IP-CIDR6":
+		r.Type = "IP-CIDR"
+		_, r.ipnet, err = net.ParseCIDR(r.Value)
+	case "DST-PORT":
+		lo, hi := r.Value, r.Value
+		if i := strings.IndexByte(r.Value, '-'); i >= 0 {
+			lo, hi = r.Value[:i], r.Value[i+1:]
+		}
+		if r.lo, err = strconv.Atoi(lo); err == nil {
+			r.hi, err = strconv.Atoi(hi)
+		}
+		if err == nil && (r.lo < 0 || r.hi > 65535 || r.lo > r.hi) {
+			err = errors.New("invalid port range")
+		}
+	case "GEOIP":
+		r.Value = strings.ToUpper(r.Value)
+		if r.Value == "" {
+			err = errors.New("no country code")
+		}
+	case "MATCH":
+	default:
+		return nil, fmt.Errorf("rule line %d: unknown rule type %s", lineno, fields[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rule line %d: %v", lineno, err)
+	}
+	return r, nil
+}
+
+// ParseRules reads routing rules, one per line. Empty lines and lines
+// starting with # are ignored. A rule is TYPE,VALUE,ACTION, where TYPE is:
+//
+//	DOMAIN          the domain name
+//	DOMAIN-SUFFIX   the domain name or its subdomains
+//	DOMAIN-KEYWORD  domain names containing the value
+//	DOMAIN-REGEX    domain names matching the regular expression
+//	IP-CIDR         IP addresses in the network, domain names are not resolved
+//	DST-PORT        the port or port range, such as 8000-9000
+//	GEOIP           IP addresses in the country, given by its ISO 3166-1 code
+//	                such as CN, see Router for domain names
+//
+// ACTION is PROXY, DIRECT or REJECT. PROXY:group relays through the named
+// server group. The rule MATCH,ACTION matches everything, it's usually the
+// last one.
+func ParseRules(rd io.Reader) ([]*Rule, error) {
+	var rules []*Rule
+	scanner := bufio.NewScanner(rd)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		r, err := parseRule(line, lineno)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Router chooses the action for each target with the first matching rule.
+// Targets matching no rule are proxied. The rules can be replaced while in
+// use.
+type Router struct {
+	// GeoIP is the database used by GEOIP rules, which match nothing if
+	// it's nil.
+	GeoIP *GeoIP
+	// Resolve makes GEOIP rules match domain names by their addresses,
+	// resolved with the system resolver and cached. Domain names never match
+	// GEOIP rules otherwise.
+	Resolve bool
+
+	mu    sync.RWMutex
+	rules []*Rule
+
+	once  sync.Once
+	hosts *hostCache
+}
+
+// NewRouter returns a router using rules.
+func NewRouter(rules []*Rule) *Router {
+	return &Router{rules: rules}
+}
+
+// SetRules replaces the rules.
+func (r *Router) SetRules(rules []*Rule) {
+	r.mu.Lock()
+	r.rules = rules
+	r.mu.Unlock()
+}
+
+func (r *Router) initHosts() {
+	r.hosts = newHostCache(defaultHostCacheSize)
+}
+
+// country returns the country of host, which is an IP address if ip is not
+// nil, or the empty string if unknown.
+func (r *Router) country(host string, ip net.IP) string {
+	if r.GeoIP == nil {
+		return ""
+	}
+	if ip == nil {
+		if !r.Resolve {
+			return ""
+		}
+		r.once.Do(r.initHosts)
+		ips := r.hosts.lookup(host)
+		if len(ips) == 0 {
+			return ""
+		}
+		ip = ips[0]
+	}
+	return r.GeoIP.Country(ip)
+}
+
+// Match returns the first rule matching addr, which is a host:port address,
+// or nil if no rule matches.
+func (r *Router) Match(addr string) *Rule {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	port, _ := strconv.Atoi(portStr)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	r.mu.RLock()
+	rules := r.rules
+	r.mu.RUnlock()
+	// the country is looked up on the first GEOIP rule, as it may resolve
+	// host
+	country, looked := "", false
+	for _, rule := range rules {
+		if rule.Type == "GEOIP" {
+			if !looked {
+				country, looked = r.country(host, ip), true
+			}
+			if country == rule.Value {
+				return rule
+			}
+			continue
+		}
+		if rule.match(host, ip, port) {
+			return rule
+		}
+	}
+	return nil
+}
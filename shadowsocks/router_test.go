@@ -0,0 +1,194 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+# comment
+DOMAIN-SUFFIX, Example.COM., DIRECT
+ip-cidr6,2001:db8::/32,PROXY:us
+FINAL,reject
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"line 3 DOMAIN-SUFFIX,example.com,DIRECT",
+		"line 4 IP-CIDR,2001:db8::/32,PROXY:us",
+		"line 5 MATCH,REJECT",
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("got %d rules, want %d", len(rules), len(want))
+	}
+	for i, r := range rules {
+		if r.String() != want[i] {
+			t.Errorf("rule %d is %q, want %q", i, r, want[i])
+		}
+	}
+
+	for _, line := range []string{
+		"DOMAIN,example.com",
+		"MATCH,example.com,DIRECT",
+		"DOMAIN,example.com,DROP",
+		"DOMAIN,example.com,DIRECT:us",
+		"GEOIP,,DIRECT",
+		"GEOIP2,CN,DIRECT",
+		"DOMAIN-REGEX,(,DIRECT",
+		"IP-CIDR,10.0.0.0,DIRECT",
+		"DST-PORT,9000-8000,DIRECT",
+		"DST-PORT,70000,DIRECT",
+	} {
+		if _, err := ParseRules(strings.NewReader(line)); err == nil {
+			t.Errorf("ParseRules(%q) succeeded", line)
+		}
+	}
+}
+
+func TestRouterMatch(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+DOMAIN,ads.example.com,REJECT
+DOMAIN-SUFFIX,example.com,DIRECT
+DOMAIN-KEYWORD,google,PROXY:us
+DOMAIN-REGEX,^cdn[0-9]+\.,DIRECT
+IP-CIDR,10.0.0.0/8,DIRECT
+IP-CIDR6,fd00::/8,DIRECT
+DST-PORT,6881-6889,REJECT
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter(rules)
+	tests := []struct {
+		addr string
+		line int // 0 if no rule matches
+	}{
+		{"ads.example.com:443", 2},
+		{"ADS.Example.com.:80", 2},
+		{"example.com:80", 3},
+		{"www.example.com:80", 3},
+		{"notexample.com:80", 0},
+		{"www.google.co.jp:443", 4},
+		{"cdn12.example.net:80", 5},
+		{"www.cdn12.example.net:80", 0},
+		{"10.1.2.3:22", 6},
+		{"[fd00::1]:22", 7},
+		{"11.1.2.3:6881", 8},
+		{"11.1.2.3:6890", 0},
+	}
+	for _, tt := range tests {
+		rule := r.Match(tt.addr)
+		line := 0
+		if rule != nil {
+			line = rule.Line
+		}
+		if line != tt.line {
+			t.Errorf("Match(%q) matched line %d, want %d", tt.addr, line, tt.line)
+		}
+	}
+
+	r.SetRules(nil)
+	if rule := r.Match("ads.example.com:443"); rule != nil {
+		t.Errorf("rule %v matched after removing the rules", rule)
+	}
+}
+
+func TestLocalRouter(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+
+	// the default server is dead, only the direct and group rules work
+	dead := &Upstream{Server: unusedAddr(t), Cipher: cipher}
+	l := NewLocal([]*Upstream{dead}, nil)
+	l.Router = NewRouter(nil)
+	l.Groups = map[string][]*Upstream{"live": {{Server: srvAddr, Cipher: cipher}}}
+	defer l.Close()
+
+	target := echo.Addr().String()
+	rawaddr, err := RawAddr(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rules  string
+		err    error
+		reason CloseReason
+	}{
+		{"IP-CIDR,127.0.0.0/8,DIRECT", nil, ""},
+		{"IP-CIDR,127.0.0.0/8,PROXY:live", nil, ""},
+		{"IP-CIDR,127.0.0.0/8,REJECT", errRejected, CloseRejected},
+	}
+	for _, tt := range tests {
+		rules, err := ParseRules(strings.NewReader(tt.rules))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Router.SetRules(rules)
+		e := &AccessEntry{}
+		ctx := context.WithValue(context.Background(), accessEntryKey{}, e)
+		remote, err := l.Connect(ctx, rawaddr, target)
+		if err != tt.err {
+			t.Errorf("rules %q: Connect returned %v, want %v", tt.rules, err, tt.err)
+		}
+		if e.Reason != tt.reason {
+			t.Errorf("rules %q: close reason %q, want %q", tt.rules, e.Reason, tt.reason)
+		}
+		if err == nil {
+			remote.SetDeadline(time.Now().Add(5 * time.Second))
+			checkEcho(t, remote)
+			remote.Close()
+		}
+	}
+
+	// no rule matches, the dead server is used
+	l.Router.SetRules(nil)
+	e := &AccessEntry{}
+	ctx := context.WithValue(context.Background(), accessEntryKey{}, e)
+	if _, err = l.Connect(ctx, rawaddr, target); err == nil || e.Reason != CloseDialError {
+		t.Errorf("Connect through the dead server returned %v, close reason %q", err, e.Reason)
+	}
+}
+
+func TestHTTPProxyRejected(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader("MATCH,REJECT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLocal(nil, &HTTPHandler{})
+	l.Router = NewRouter(rules)
+	go l.Serve(ln)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("CONNECT returned %s, want 403", resp.Status)
+	}
+}
@@ -0,0 +1,377 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ErrServerClosed is returned by Serve and ServePacket after Shutdown or
+// Close is called.
+var ErrServerClosed = errors.New("shadowsocks: server closed")
+
+// ServerHooks are optional callbacks invoked by Server. They must be safe for
+// concurrent use.
+type ServerHooks struct {
+	// Accept is called with each accepted connection before the request is
+	// read. The connection is closed if it returns false.
+	Accept func(c net.Conn) bool
+	// Closed is called with the access entry of each TCP connection or UDP
+	// session when it ends.
+	Closed func(e *AccessEntry)
+}
+
+// Server is a shadowsocks server relaying the connections accepted on its
+// listeners and the packets received on its packet connections. The zero
+// value is not usable, create it with NewServer. Options must not be changed
+// after calling Serve or ServePacket.
+type Server struct {
+	Cipher *Cipher
+	// Auth requires one time auth for all requests. Clients can always
+	// enable it on their own.
+	Auth bool
+	// Timeout is the read timeout of relayed TCP connections, zero means no
+	// timeout.
+	Timeout time.Duration
+	// UDPTimeout is how long a UDP session is kept without receiving any
+	// reply, default to 30 seconds.
+	UDPTimeout time.Duration
+	// Dialer connects to the targets of TCP requests, net.Dialer is used if
+	// nil.
+	Dialer proxy.ContextDialer
+	Hooks  ServerHooks
+	// Observer receives the events of relayed connections if not nil.
+	Observer Observer
+	// Logger replaces the package logger if not nil.
+	Logger Logger
+	// AccessLog replaces the package access logger if not nil.
+	AccessLog Logger
+
+	connTracker
+	packetConns map[net.PacketConn]*udpRelay // guarded by connTracker.mu
+
+	connCnt       int32
+	loggedConnCnt int32 // peak connection number level already logged
+}
+
+// NewServer returns a server using cipher. One time auth is required if the
+// cipher is created with an "-auth" method.
+func NewServer(cipher *Cipher) *Server {
+	return &Server{Cipher: cipher, Auth: cipher.IsOta()}
+}
+
+const logCntDelta = 100
+
+func (s *Server) logger() Logger {
+	return loggerOr(s.Logger)
+}
+
+func (s *Server) logf(level LogLevel, format string, args ...interface{}) {
+	logfTo(s.logger(), level, format, args...)
+}
+
+// observer returns the observer writing the access log, calling Hooks.Closed
+// and forwarding to s.Observer.
+func (s *Server) observer() Observer {
+	var closed Observer
+	if s.Hooks.Closed != nil {
+		closed = closedObserver{f: s.Hooks.Closed}
+	}
+	return newMultiObserver(accessLogObserver{l: s.AccessLog}, closed, s.Observer)
+}
+
+func (s *Server) udpTimeout() time.Duration {
+	if s.UDPTimeout > 0 {
+		return s.UDPTimeout
+	}
+	return udpTimeout
+}
+
+func (s *Server) trackPacketConn(pc net.PacketConn, relay *udpRelay, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.packetConns == nil {
+			s.packetConns = make(map[net.PacketConn]*udpRelay)
+		}
+		s.packetConns[pc] = relay
+	} else {
+		delete(s.packetConns, pc)
+	}
+	return true
+}
+
+// Serve accepts connections on ln and relays them until ln is closed. The
+// listener is closed by Shutdown and Close, in which case ErrServerClosed is
+// returned, otherwise the accept error is returned.
+func (s *Server) Serve(ln net.Listener) error {
+	if !s.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.handleConnection(conn, port)
+	}
+}
+
+// ServePacket relays the UDP packets received on pc until pc is closed. Each
+// call has its own NAT table. Like Serve, ErrServerClosed is returned after
+// Shutdown or Close.
+func (s *Server) ServePacket(pc net.PacketConn) error {
+	relay := newUDPRelay(s.udpTimeout(), s.observer(), s.Logger)
+	if !s.trackPacketConn(pc, relay, true) {
+		return ErrServerClosed
+	}
+	defer s.trackPacketConn(pc, relay, false)
+	defer relay.nat.closeAll()
+	spc := NewSecurePacketConn(pc, s.Cipher.Copy(), s.Auth)
+	for {
+		if err := relay.readAndHandle(spc); err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			// Errors of the underlying connection are net.Error, others
+			// are about a single bad packet.
+			if _, ok := err.(net.Error); ok {
+				return err
+			}
+			s.logf(LevelDebug, "%v", err)
+		}
+	}
+}
+
+// Shutdown stops the server gracefully: listeners and packet connections are
+// closed, UDP sessions are ended, then it waits for active TCP connections to
+// finish. If ctx is done before that, remaining connections are closed and
+// ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeListeners(s.closePacketConns)
+	return s.waitConns(ctx)
+}
+
+// Close stops the server immediately, closing all listeners, packet
+// connections and active connections.
+func (s *Server) Close() error {
+	s.closeListeners(s.closePacketConns)
+	s.closeConns()
+	return nil
+}
+
+// closePacketConns is called with s.mu held.
+func (s *Server) closePacketConns() {
+	for pc, relay := range s.packetConns {
+		pc.Close()
+		relay.nat.closeAll()
+	}
+}
+
+// readRequest reads the address header of a request, verifying its one time
+// auth if required.
+func (s *Server) readRequest(conn *Conn) (host string, ota bool, err error) {
+	setReadTimeout(conn, s.Timeout)
+
+	// buf size should at least have the same size with the largest possible
+	// request size (when addrType is 3, domain name has at most 256 bytes)
+	// 1(addrType) + 1(lenByte) + 255(max length address) + 2(port) + 10(hmac-sha1)
+	buf := make([]byte, 269)
+	// read till we get possible domain length field
+	if _, err = io.ReadFull(conn, buf[:idType+1]); err != nil {
+		return
+	}
+
+	var reqStart, reqEnd int
+	addrType := buf[idType]
+	switch addrType & AddrMask {
+	case typeIPv4:
+		reqStart, reqEnd = idIP0, lenIPv4
+	case typeIPv6:
+		reqStart, reqEnd = idIP0, lenIPv6
+	case typeDm:
+		if _, err = io.ReadFull(conn, buf[idType+1:idDmLen+1]); err != nil {
+			return
+		}
+		reqStart, reqEnd = idDm0, int(buf[idDmLen])+lenDmBase
+	default:
+		err = fmt.Errorf("addr type %d not supported", addrType&AddrMask)
+		return
+	}
+
+	if _, err = io.ReadFull(conn, buf[reqStart:reqEnd]); err != nil {
+		return
+	}
+
+	switch addrType & AddrMask {
+	case typeIPv4:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
+	case typeIPv6:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
+	case typeDm:
+		host = string(buf[idDm0 : idDm0+int(buf[idDmLen])])
+	}
+	// parse port
+	port := binary.BigEndian.Uint16(buf[reqEnd-2 : reqEnd])
+	host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	// if specified one time auth enabled, we should verify this
+	if s.Auth || addrType&OneTimeAuthMask > 0 {
+		ota = true
+		if _, err = io.ReadFull(conn, buf[reqEnd:reqEnd+lenHmacSha1]); err != nil {
+			return
+		}
+		iv := conn.GetIv()
+		key := conn.GetKey()
+		actualHmacSha1Buf := HmacSha1(append(iv, key...), buf[:reqEnd])
+		if !bytes.Equal(buf[reqEnd:reqEnd+lenHmacSha1], actualHmacSha1Buf) {
+			s.logf(LevelDebug, "verify one time auth failed, iv=%v key=%v data=%v", iv, key, buf[:reqEnd])
+			err = ErrOTAFailed
+			return
+		}
+	}
+	return
+}
+
+func (s *Server) dial(host string) (net.Conn, error) {
+	if s.Dialer != nil {
+		return s.Dialer.DialContext(context.Background(), "tcp", host)
+	}
+	return net.Dial("tcp", host)
+}
+
+func (s *Server) handleConnection(c net.Conn, port string) {
+	defer s.trackConn(c, false)
+	l := s.logger()
+	if s.Hooks.Accept != nil && !s.Hooks.Accept(c) {
+		c.Close()
+		return
+	}
+	conn := NewConn(c, s.Cipher.Copy())
+
+	id := NewConnID()
+	access := &AccessEntry{
+		ConnID:  id,
+		Network: "tcp",
+		Client:  conn.RemoteAddr().String(),
+		Port:    port,
+		Start:   time.Now(),
+		Reason:  CloseEOF,
+	}
+	obs := s.observer()
+	obs.Accepted(access)
+	defer obs.Closed(access)
+
+	cnt := atomic.AddInt32(&s.connCnt, 1)
+	defer atomic.AddInt32(&s.connCnt, -1)
+	logged := atomic.LoadInt32(&s.loggedConnCnt)
+	if cnt >= logged+logCntDelta && atomic.CompareAndSwapInt32(&s.loggedConnCnt, logged, logged+logCntDelta) {
+		s.logf(LevelInfo, "Number of client connections reaches %d", logged+logCntDelta)
+	}
+
+	// function arguments are always evaluated, so surround debug statement
+	// with if statement
+	if l.Enabled(LevelDebug) {
+		l.Log(LevelDebug, "new client", F(KeyConnID, id),
+			F(KeyClient, conn.RemoteAddr()), F(KeyPort, port))
+	}
+	closed := false
+	defer func() {
+		if l.Enabled(LevelDebug) {
+			l.Log(LevelDebug, "closed pipe", F(KeyConnID, id),
+				F(KeyClient, conn.RemoteAddr()), F(KeyTarget, access.Target))
+		}
+		if !closed {
+			conn.Close()
+		}
+	}()
+
+	host, ota, err := s.readRequest(conn)
+	access.Target, access.OTA = host, ota
+	if err != nil {
+		l.Log(LevelWarn, "error getting request", F(KeyConnID, id),
+			F(KeyClient, conn.RemoteAddr()), F(KeyPort, port), F(KeyError, err))
+		if err == ErrOTAFailed {
+			access.Reason = CloseOTAFailure
+		} else {
+			access.Reason = CloseRequestError
+		}
+		return
+	}
+	// ensure the host does not contain some illegal characters, NUL may panic on Win32
+	if strings.ContainsRune(host, 0x00) {
+		l.Log(LevelWarn, "invalid domain name", F(KeyConnID, id),
+			F(KeyClient, conn.RemoteAddr()), F(KeyPort, port))
+		access.Reason = CloseRequestError
+		return
+	}
+	obs.Handshake(access)
+	if l.Enabled(LevelDebug) {
+		l.Log(LevelDebug, "connecting", F(KeyConnID, id), F(KeyTarget, host))
+	}
+	remote, err := s.dial(host)
+	obs.Dialed(access, host, err)
+	if err != nil {
+		if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
+			// log too many open file error
+			// EMFILE is process reaches open file limits, ENFILE is system limit
+			l.Log(LevelError, "dial error", F(KeyConnID, id), F(KeyError, err))
+		} else {
+			l.Log(LevelWarn, "error connecting to target", F(KeyConnID, id),
+				F(KeyTarget, host), F(KeyError, err))
+		}
+		access.Reason = CloseDialError
+		return
+	}
+	defer func() {
+		if !closed {
+			remote.Close()
+		}
+	}()
+	if l.Enabled(LevelDebug) {
+		l.Log(LevelDebug, "piping", F(KeyConnID, id), F(KeyClient, conn.RemoteAddr()),
+			F(KeyTarget, host), F("ota", ota), F("conn_ota", conn.IsOta()))
+	}
+	meter := newTransferMeter(obs, access)
+	var up int64
+	var upErr error
+	upDone := make(chan struct{})
+	go func() {
+		if ota {
+			up, upErr = pipeThenCloseOta(conn, remote, s.Timeout, s.Logger, id, meter.countUp)
+		} else {
+			up, upErr = pipeThenClose(conn, remote, s.Timeout, s.Logger, id, meter.countUp)
+		}
+		close(upDone)
+	}()
+	down, downErr := pipeThenClose(remote, conn, s.Timeout, s.Logger, id, meter.countDown)
+	closed = true
+	// Closing conn stops the other direction, wait for it to get the
+	// number of bytes sent.
+	<-upDone
+	meter.flush()
+	access.BytesUp, access.BytesDown = up, down
+	access.Reason = CloseReasonOf(upErr, downErr)
+}
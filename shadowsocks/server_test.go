@@ -0,0 +1,167 @@
+package shadowsocks
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTCPEcho starts a TCP server echoing what it receives.
+func startTCPEcho(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestServerServe(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(cipher)
+	entries := make(chan *AccessEntry, 1)
+	srv.Hooks.Closed = func(e *AccessEntry) { entries <- e }
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	c, err := Dial(echo.Addr().String(), ln.Addr().String(), cipher.Copy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("hello")
+	if _, err = c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(msg) {
+		t.Errorf("got %q, want %q", buf, msg)
+	}
+
+	// Shutdown waits for the active connection.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown with active connection returned %v", err)
+	}
+	if err = <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+	c.Close()
+
+	select {
+	case e := <-entries:
+		if e.Target != echo.Addr().String() {
+			t.Errorf("access entry target %s, want %s", e.Target, echo.Addr())
+		}
+		if e.BytesUp != int64(len(msg)) {
+			t.Errorf("access entry bytes up %d, want %d", e.BytesUp, len(msg))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	if err = srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+	if err = srv.Serve(ln); err != ErrServerClosed {
+		t.Errorf("Serve after Shutdown returned %v", err)
+	}
+}
+
+func TestServerAcceptHook(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(cipher)
+	srv.Hooks.Accept = func(c net.Conn) bool { return false }
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("rejected connection read returned %v, want EOF", err)
+	}
+}
+
+func TestServerServePacket(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startUDPEcho(t)
+	defer echo.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(cipher)
+	served := make(chan error, 1)
+	go func() { served <- srv.ServePacket(pc) }()
+
+	d, err := NewDialer(pc.LocalAddr().String(), cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.ListenPacket("udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	msg := []byte("ping")
+	if _, err = c.WriteTo(msg, echo.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != string(msg) {
+		t.Errorf("got %q, want %q", buf[:n], msg)
+	}
+
+	if err = srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+	if err = <-served; err != ErrServerClosed {
+		t.Errorf("ServePacket returned %v, want ErrServerClosed", err)
+	}
+}
@@ -0,0 +1,82 @@
+package shadowsocks
+
+import (
+	"sync"
+)
+
+// ServerList holds servers and server groups which can be replaced while in
+// use, for example by a Local, a HealthChecker and a StatusHandler sharing
+// it. Create it with NewServerList.
+type ServerList struct {
+	mu      sync.RWMutex
+	servers []*Upstream
+	groups  map[string][]*Upstream
+
+	balancer       Balancer
+	groupBalancers map[string]Balancer
+	hasBalancers   bool
+}
+
+// NewServerList returns a list of servers and groups, as in Set.
+func NewServerList(servers []*Upstream, groups map[string][]*Upstream) *ServerList {
+	s := &ServerList{}
+	s.Set(servers, groups)
+	return s
+}
+
+// Get returns the servers and the groups, which must not be modified.
+func (s *ServerList) Get() ([]*Upstream, map[string][]*Upstream) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.servers, s.groups
+}
+
+// Set replaces the servers and the groups, whose servers should be in
+// servers. The new servers with the address, cipher and weight of a current
+// one are replaced by it, so they keep their state, such as their circuit
+// breaker and health. Established connections keep their server.
+func (s *ServerList) Set(servers []*Upstream, groups map[string][]*Upstream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := make(map[string]*Upstream, len(s.servers))
+	for _, se := range s.servers {
+		current[se.Server] = se
+	}
+	kept := make(map[*Upstream]*Upstream)
+	list := make([]*Upstream, len(servers))
+	for i, se := range servers {
+		if old := current[se.Server]; old != nil && old.Weight == se.Weight && old.Cipher.equal(se.Cipher) {
+			kept[se] = old
+			se = old
+		}
+		list[i] = se
+	}
+	groupList := make(map[string][]*Upstream, len(groups))
+	for name, group := range groups {
+		g := make([]*Upstream, len(group))
+		for i, se := range group {
+			if old := kept[se]; old != nil {
+				se = old
+			}
+			g[i] = se
+		}
+		groupList[name] = g
+	}
+	s.servers, s.groups = list, groupList
+}
+
+// SetBalancers replaces the balancer of the servers and those of the groups,
+// which then replace the balancers of the Local using the list.
+func (s *ServerList) SetBalancers(balancer Balancer, groups map[string]Balancer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.balancer, s.groupBalancers, s.hasBalancers = balancer, groups, true
+}
+
+// Balancers returns the balancers given to SetBalancers, ok is false if it
+// was never called.
+func (s *ServerList) Balancers() (balancer Balancer, groups map[string]Balancer, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.balancer, s.groupBalancers, s.hasBalancers
+}
@@ -0,0 +1,68 @@
+package shadowsocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServerListSet(t *testing.T) {
+	newCipher := func(password string) *Cipher {
+		c, err := NewCipher("aes-128-cfb", password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	se1 := &Upstream{Server: "192.0.2.1:8388", Cipher: newCipher("foobar")}
+	se2 := &Upstream{Server: "192.0.2.2:8388", Cipher: newCipher("foobar")}
+	list := NewServerList([]*Upstream{se1, se2}, map[string][]*Upstream{"a": {se2}})
+	se1.breaker.failure(time.Now())
+
+	same1 := &Upstream{Server: se1.Server, Cipher: newCipher("foobar")}
+	changed2 := &Upstream{Server: se2.Server, Cipher: newCipher("barfoo")}
+	se3 := &Upstream{Server: "192.0.2.3:8388", Cipher: newCipher("foobar")}
+	list.Set([]*Upstream{same1, changed2, se3}, map[string][]*Upstream{"a": {same1, se3}})
+
+	servers, groups := list.Get()
+	if len(servers) != 3 || servers[0] != se1 || servers[1] != changed2 || servers[2] != se3 {
+		t.Errorf("servers %v, want the unchanged server kept", servers)
+	}
+	if se1.Breaker() != BreakerOpen {
+		t.Error("state of the unchanged server lost")
+	}
+	if g := groups["a"]; len(g) != 2 || g[0] != se1 || g[1] != se3 {
+		t.Errorf("group %v doesn't use the kept server", g)
+	}
+
+	// the weight is part of the server
+	list.Set([]*Upstream{{Server: se1.Server, Cipher: newCipher("foobar"), Weight: 2}}, nil)
+	if servers, _ = list.Get(); servers[0] == se1 {
+		t.Error("server kept with a different weight")
+	}
+}
+
+func TestServerListBalancers(t *testing.T) {
+	servers := testUpstreams(3)
+	list := NewServerList(servers, map[string][]*Upstream{"a": servers[1:]})
+	l := NewLocal(nil, nil)
+	l.ServerList = list
+	reverse := BalancerFunc(func(servers []*Upstream, addr string) []*Upstream {
+		r := make([]*Upstream, len(servers))
+		for i, se := range servers {
+			r[len(servers)-1-i] = se
+		}
+		return r
+	})
+	l.Balancer = reverse
+
+	if s := serverNames(l.balancer("").Pick(servers, "")); s != "321" {
+		t.Errorf("order %s with the balancer of Local, want 321", s)
+	}
+	list.SetBalancers(nil, map[string]Balancer{"a": reverse})
+	if s := serverNames(l.balancer("").Pick(servers, "")); s != "123" {
+		t.Errorf("order %s with the balancers of the list, want 123", s)
+	}
+	if s := serverNames(l.balancer("a").Pick(servers[1:], "")); s != "32" {
+		t.Errorf("group order %s, want 32", s)
+	}
+}
@@ -0,0 +1,550 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	errAddrType      = errors.New("socks addr type not supported")
+	errVer           = errors.New("socks version not supported")
+	errMethod        = errors.New("socks no acceptable authentication method")
+	errAuthExtraData = errors.New("socks authentication get extra data")
+	errAuthVer       = errors.New("socks username/password authentication version not supported")
+	errAuthFailed    = errors.New("socks username/password authentication failed")
+	errReqExtraData  = errors.New("socks request get extra data")
+	errCmd           = errors.New("socks command not supported")
+	errServerClosed  = errors.New("socks connection closed by the server")
+)
+
+const (
+	socksVer5            = 5
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksRepSucceeded          = 0
+	socksRepGeneralFailure     = 1
+	socksRepNotAllowed         = 2
+	socksRepNetworkUnreachable = 3
+	socksRepHostUnreachable    = 4
+	socksRepConnectionRefused  = 5
+
+	socksMethodNoAuth       = 0
+	socksMethodUserPass     = 2
+	socksMethodNoAcceptable = 0xff
+
+	socksUserPassVer = 1
+)
+
+// SOCKS5Handler is the InboundHandler serving SOCKS5 clients. CONNECT and UDP
+// ASSOCIATE commands are supported.
+type SOCKS5Handler struct {
+	// Users are the username and password pairs for username/password
+	// authentication (RFC 1929).
+	Users map[string]string
+	// AuthRequired rejects clients that don't authenticate with Users.
+	AuthRequired bool
+	// DeferReply replies to CONNECT requests once connected, with the
+	// local address of the connection to the server or target, or with
+	// the error code of the failure. By default success is replied at
+	// once, saving a round trip, and the connection is closed on failure.
+	DeferReply bool
+	// ProbeTimeout, with DeferReply, is how long to wait after connecting
+	// through a server before replying success. Servers close the
+	// connection when they can't connect to the target, which is replied
+	// as host unreachable if it happens in time. Zero disables the probe.
+	ProbeTimeout time.Duration
+}
+
+func (h *SOCKS5Handler) ServeInbound(ctx context.Context, conn net.Conn, l *Local) {
+	lg := l.logger()
+	id := accessEntry(ctx).ConnID
+	if lg.Enabled(LevelDebug) {
+		lg.Log(LevelDebug, "socks connect", F(KeyConnID, id), F(KeyClient, conn.RemoteAddr()))
+	}
+
+	setReadTimeout(conn, l.timeout())
+	user, err := h.handShake(conn)
+	if err != nil {
+		lg.Log(LevelWarn, "socks handshake failed", F(KeyConnID, id),
+			F(KeyClient, conn.RemoteAddr()), F(KeyUser, user), F(KeyError, err))
+		return
+	}
+	setReadTimeout(conn, l.timeout())
+	cmd, rawaddr, addr, err := getSocksRequest(conn)
+	if err != nil {
+		lg.Log(LevelWarn, "error getting request", F(KeyConnID, id),
+			F(KeyClient, conn.RemoteAddr()), F(KeyError, err))
+		return
+	}
+	l.Handshake(ctx, addr, user)
+	if cmd == socksCmdUDPAssociate {
+		handleUDPAssociate(ctx, conn, l)
+		return
+	}
+	if !h.DeferReply {
+		// Sending connection established message immediately to client.
+		// This some round trip time for creating socks connection with the client.
+		// But if connection failed, the client will get connection reset error.
+		_, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x43})
+		if err != nil {
+			lg.Log(LevelDebug, "send connection confirmation failed", F(KeyConnID, id), F(KeyError, err))
+			return
+		}
+	}
+
+	remote, err := l.Connect(ctx, rawaddr, addr)
+	if err != nil {
+		if servers, _ := l.upstreams(); len(servers) > 1 {
+			lg.Log(LevelError, "Failed connect to all avaiable shadowsocks server",
+				F(KeyConnID, id), F(KeyTarget, addr))
+		}
+		if h.DeferReply {
+			socksReply(conn, socksErrorReply(err), nil)
+		}
+		return
+	}
+	if h.DeferReply {
+		if remote, err = h.probe(remote); err != nil {
+			lg.Log(LevelDebug, "server closed the connection", F(KeyConnID, id),
+				F(KeyTarget, addr), F(KeyError, err))
+			socksReply(conn, socksErrorReply(err), nil)
+			return
+		}
+		if err = socksReply(conn, socksRepSucceeded, remote.LocalAddr()); err != nil {
+			remote.Close()
+			return
+		}
+	}
+	l.Relay(ctx, conn, remote)
+	if lg.Enabled(LevelDebug) {
+		lg.Log(LevelDebug, "closed connection", F(KeyConnID, id), F(KeyUser, user), F(KeyTarget, addr))
+	}
+}
+
+// probe waits up to ProbeTimeout for the first data of remote if it's
+// connected through a server. errServerClosed is returned if the server
+// closes the connection meanwhile.
+func (h *SOCKS5Handler) probe(remote net.Conn) (net.Conn, error) {
+	uc, ok := remote.(*upstreamConn)
+	if !ok || h.ProbeTimeout <= 0 {
+		return remote, nil
+	}
+	// read the raw connection, so a timeout in the middle of the IV doesn't
+	// lose it, and keep what's read for the cipher
+	raw := uc.Conn.Conn
+	raw.SetReadDeadline(time.Now().Add(h.ProbeTimeout))
+	buf := make([]byte, 1)
+	n, err := raw.Read(buf)
+	raw.SetReadDeadline(time.Time{})
+	if n > 0 {
+		uc.Conn.Conn = &bufferedConn{raw, io.MultiReader(bytes.NewReader(buf[:n]), raw)}
+		return remote, nil
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return remote, nil
+	}
+	remote.Close()
+	return nil, errServerClosed
+}
+
+// handShake negotiates the authentication method with the client. If the
+// client authenticates with username and password, the username is returned.
+func (h *SOCKS5Handler) handShake(conn net.Conn) (user string, err error) {
+	const (
+		idVer     = 0
+		idNmethod = 1
+	)
+	// version identification and method selection message in theory can have
+	// at most 256 methods, plus version and nmethod field in total 258 bytes
+	// the current rfc defines only 3 authentication methods (plus 2 reserved),
+	// so it won't be such long in practice
+
+	buf := make([]byte, 258)
+
+	var n int
+	// make sure we get the nmethod field
+	if n, err = io.ReadAtLeast(conn, buf, idNmethod+1); err != nil {
+		return
+	}
+	if buf[idVer] != socksVer5 {
+		return "", errVer
+	}
+	nmethod := int(buf[idNmethod])
+	msgLen := nmethod + 2
+	if n == msgLen { // handshake done, common case
+		// do nothing, jump directly to send confirmation
+	} else if n < msgLen { // has more methods to read, rare case
+		if _, err = io.ReadFull(conn, buf[n:msgLen]); err != nil {
+			return
+		}
+	} else { // error, should not get extra data
+		return "", errAuthExtraData
+	}
+	method := h.selectMethod(buf[idNmethod+1 : msgLen])
+	if _, err = conn.Write([]byte{socksVer5, method}); err != nil {
+		return
+	}
+	switch method {
+	case socksMethodNoAcceptable:
+		err = errMethod
+	case socksMethodUserPass:
+		user, err = h.authUserPass(conn)
+	}
+	return
+}
+
+// selectMethod picks username/password authentication if there are users
+// configured and the client supports it. Otherwise no authentication is used,
+// unless authentication is required.
+func (h *SOCKS5Handler) selectMethod(methods []byte) byte {
+	var noAuth, userPass bool
+	for _, m := range methods {
+		switch m {
+		case socksMethodNoAuth:
+			noAuth = true
+		case socksMethodUserPass:
+			userPass = true
+		}
+	}
+	if userPass && len(h.Users) > 0 {
+		return socksMethodUserPass
+	}
+	if noAuth && !h.AuthRequired {
+		return socksMethodNoAuth
+	}
+	return socksMethodNoAcceptable
+}
+
+// authUserPass does the username/password subnegotiation defined in rfc1929.
+func (h *SOCKS5Handler) authUserPass(conn net.Conn) (user string, err error) {
+	const (
+		idVer  = 0
+		idUlen = 1
+	)
+	// 1(ver) + 1(ulen) + 255(uname) + 1(plen) + 255(passwd)
+	buf := make([]byte, 513)
+	if _, err = io.ReadFull(conn, buf[:idUlen+1]); err != nil {
+		return
+	}
+	if buf[idVer] != socksUserPassVer {
+		return "", errAuthVer
+	}
+	ulen := int(buf[idUlen])
+	// read username and the password length field
+	if _, err = io.ReadFull(conn, buf[idUlen+1:idUlen+1+ulen+1]); err != nil {
+		return
+	}
+	uname := string(buf[idUlen+1 : idUlen+1+ulen])
+	idPlen := idUlen + 1 + ulen
+	plen := int(buf[idPlen])
+	if _, err = io.ReadFull(conn, buf[idPlen+1:idPlen+1+plen]); err != nil {
+		return
+	}
+	passwd := buf[idPlen+1 : idPlen+1+plen]
+
+	expected, ok := h.Users[uname]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), passwd) != 1 {
+		// any non-zero status means failure, client must close the connection
+		conn.Write([]byte{socksUserPassVer, 1})
+		return uname, errAuthFailed
+	}
+	_, err = conn.Write([]byte{socksUserPassVer, 0})
+	return uname, err
+}
+
+// getSocksRequest reads a SOCKS5 request. rawaddr is the address part of the
+// request, which is also the shadowsocks address header.
+func getSocksRequest(conn net.Conn) (cmd byte, rawaddr []byte, host string, err error) {
+	const (
+		idVer   = 0
+		idCmd   = 1
+		idType  = 3 // address type index
+		idIP0   = 4 // ip addres start index
+		idDmLen = 4 // domain address length index
+		idDm0   = 5 // domain address start index
+
+		lenIPv4   = 3 + 1 + net.IPv4len + 2 // 3(ver+cmd+rsv) + 1addrType + ipv4 + 2port
+		lenIPv6   = 3 + 1 + net.IPv6len + 2 // 3(ver+cmd+rsv) + 1addrType + ipv6 + 2port
+		lenDmBase = 3 + 1 + 1 + 2           // 3 + 1addrType + 1addrLen + 2port, plus addrLen
+	)
+	// refer to readRequest in server.go for why set buffer size to 263
+	buf := make([]byte, 263)
+	var n int
+	// read till we get possible domain length field
+	if n, err = io.ReadAtLeast(conn, buf, idDmLen+1); err != nil {
+		return
+	}
+	// check version and cmd
+	if buf[idVer] != socksVer5 {
+		err = errVer
+		return
+	}
+	cmd = buf[idCmd]
+	if cmd != socksCmdConnect && cmd != socksCmdUDPAssociate {
+		err = errCmd
+		return
+	}
+
+	reqLen := -1
+	switch buf[idType] {
+	case typeIPv4:
+		reqLen = lenIPv4
+	case typeIPv6:
+		reqLen = lenIPv6
+	case typeDm:
+		reqLen = int(buf[idDmLen]) + lenDmBase
+	default:
+		err = errAddrType
+		return
+	}
+
+	if n == reqLen {
+		// common case, do nothing
+	} else if n < reqLen { // rare case
+		if _, err = io.ReadFull(conn, buf[n:reqLen]); err != nil {
+			return
+		}
+	} else {
+		err = errReqExtraData
+		return
+	}
+
+	rawaddr = buf[idType:reqLen]
+
+	switch buf[idType] {
+	case typeIPv4:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
+	case typeIPv6:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
+	case typeDm:
+		host = string(buf[idDm0 : idDm0+buf[idDmLen]])
+	}
+	port := binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])
+	host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	return
+}
+
+// socksReply sends a reply with the given bound address to the client, a
+// *net.TCPAddr or *net.UDPAddr. 0.0.0.0:0 is sent for other addresses.
+func socksReply(conn net.Conn, rep byte, bind net.Addr) error {
+	var ip net.IP
+	var port int
+	switch a := bind.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	buf := []byte{socksVer5, rep, 0, typeIPv4, 0, 0, 0, 0, 0, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(buf[4:], ip4)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		buf = append(buf[:3], typeIPv6)
+		buf = append(buf, ip16...)
+		buf = append(buf, 0, 0)
+	}
+	binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(port))
+	_, err := conn.Write(buf)
+	return err
+}
+
+// socksErrorReply returns the reply code for the error of Local.Connect or
+// probe. Only rejections, direct connections and servers closing the probed
+// connection give a specific code, as the result of connecting to the target
+// through a server is unknown otherwise.
+func socksErrorReply(err error) byte {
+	switch err {
+	case errRejected:
+		return socksRepNotAllowed
+	case errServerClosed:
+		return socksRepHostUnreachable
+	}
+	te, ok := err.(*targetError)
+	if !ok {
+		return socksRepGeneralFailure
+	}
+	err = te.err
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return socksRepHostUnreachable
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	switch err {
+	case syscall.ECONNREFUSED:
+		return socksRepConnectionRefused
+	case syscall.EHOSTUNREACH:
+		return socksRepHostUnreachable
+	case syscall.ENETUNREACH:
+		return socksRepNetworkUnreachable
+	}
+	if _, ok := err.(*net.DNSError); ok {
+		return socksRepHostUnreachable
+	}
+	return socksRepGeneralFailure
+}
+
+// handleUDPAssociate relays the UDP packets of the client through the
+// shadowsocks server until the controlling TCP connection is closed.
+func handleUDPAssociate(ctx context.Context, conn net.Conn, l *Local) {
+	const (
+		idRsv  = 0
+		idFrag = 2
+		idType = 3 // address type index, start of the shadowsocks header
+	)
+	lg := l.logger()
+	e := accessEntry(ctx)
+	id := e.ConnID
+	se := l.udpServer("")
+	if se == nil {
+		lg.Log(LevelWarn, "udp associate without server", F(KeyConnID, id))
+		socksReply(conn, socksRepGeneralFailure, nil)
+		return
+	}
+	// the listener may not be tcp, such as a unix socket listener given to
+	// Serve
+	caddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	laddr, lok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok || !lok {
+		lg.Log(LevelWarn, "udp associate on a non tcp connection", F(KeyConnID, id),
+			F("local", conn.LocalAddr()))
+		socksReply(conn, socksRepGeneralFailure, nil)
+		return
+	}
+	clientIP := caddr.IP
+	// bind on the address the client used to reach us, so it's reachable
+	// by the client
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: laddr.IP})
+	if err != nil {
+		lg.Log(LevelError, "udp associate listen failed", F(KeyConnID, id), F(KeyError, err))
+		socksReply(conn, socksRepGeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+
+	serverAddr, err := net.ResolveUDPAddr("udp", se.Server)
+	if err != nil {
+		lg.Log(LevelWarn, "error resolving shadowsocks server", F(KeyConnID, id),
+			F(KeyServer, se.Server), F(KeyError, err))
+		socksReply(conn, socksRepGeneralFailure, nil)
+		return
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		lg.Log(LevelError, "udp associate listen failed", F(KeyConnID, id), F(KeyError, err))
+		socksReply(conn, socksRepGeneralFailure, nil)
+		return
+	}
+	remote := NewSecurePacketConn(pc, se.Cipher.Copy(), se.Cipher.IsOta())
+	defer remote.Close()
+
+	if err = socksReply(conn, socksRepSucceeded, relay.LocalAddr()); err != nil {
+		return
+	}
+	if lg.Enabled(LevelDebug) {
+		lg.Log(LevelDebug, "udp associate", F(KeyConnID, id), F(KeyClient, conn.RemoteAddr()),
+			F("relay", relay.LocalAddr()), F(KeyServer, se.Server))
+	}
+
+	session := &AccessEntry{
+		ConnID:  id,
+		Network: "udp",
+		Client:  e.Client,
+		Port:    e.Port,
+		User:    e.User,
+		Target:  se.Server,
+		OTA:     se.Cipher.IsOta(),
+		Start:   time.Now(),
+		Reason:  CloseEOF,
+	}
+	obs := l.observer()
+	obs.UDPSessionCreated(session)
+	var up, down int64 // accessed atomically
+
+	// The client address is learned from the first packet it sends.
+	var clientMu sync.Mutex
+	var clientAddr *net.UDPAddr
+
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, addr, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !addr.IP.Equal(clientIP) {
+				continue
+			}
+			// fragmentation is not supported, drop fragments
+			if n <= idType || buf[idRsv] != 0 || buf[idRsv+1] != 0 || buf[idFrag] != 0 {
+				continue
+			}
+			clientMu.Lock()
+			clientAddr = addr
+			clientMu.Unlock()
+			// the shadowsocks udp request has the same format with the
+			// socks5 one, without the RSV and FRAG fields
+			if _, err = remote.WriteTo(buf[idType:n], serverAddr); err != nil {
+				l.logf(LevelDebug, "udp associate write to server: %v", err)
+			} else {
+				atomic.AddInt64(&up, int64(n-idType))
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, addr, err := remote.ReadFrom(buf[idType:])
+			if err != nil {
+				// socket errors stop the relay, while invalid packets
+				// are ignored
+				if _, ok := err.(net.Error); ok {
+					return
+				}
+				l.logf(LevelDebug, "udp associate read from server: %v", err)
+				continue
+			}
+			if addr.String() != serverAddr.String() {
+				continue
+			}
+			clientMu.Lock()
+			caddr := clientAddr
+			clientMu.Unlock()
+			if caddr == nil {
+				continue
+			}
+			buf[idRsv], buf[idRsv+1], buf[idFrag] = 0, 0, 0
+			buf[idType] &= AddrMask // clear one time auth flag
+			if _, err = relay.WriteToUDP(buf[:idType+n], caddr); err == nil {
+				atomic.AddInt64(&down, int64(n))
+			}
+		}
+	}()
+
+	// The association terminates when the TCP connection it arrived on
+	// terminates.
+	conn.SetReadDeadline(time.Time{})
+	io.Copy(ioutil.Discard, conn)
+	session.BytesUp = atomic.LoadInt64(&up)
+	session.BytesDown = atomic.LoadInt64(&down)
+	obs.UDPSessionExpired(session)
+	if lg.Enabled(LevelDebug) {
+		lg.Log(LevelDebug, "udp associate closed", F(KeyConnID, id))
+	}
+}
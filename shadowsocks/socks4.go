@@ -0,0 +1,116 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+var (
+	errSocks4Ver     = errors.New("socks4 version not supported")
+	errSocks4Cmd     = errors.New("socks4 command not supported")
+	errSocks4TooLong = errors.New("socks4 user id or domain too long")
+)
+
+const (
+	socksVer4 = 4
+
+	socks4RepGranted  = 0x5a
+	socks4RepRejected = 0x5b
+)
+
+// SOCKS4Handler is the InboundHandler serving SOCKS4 and SOCKS4a clients.
+// Only the CONNECT command is supported. SOCKS4 has no authentication, the
+// user ID sent by clients is ignored.
+type SOCKS4Handler struct{}
+
+func (h *SOCKS4Handler) ServeInbound(ctx context.Context, conn net.Conn, l *Local) {
+	lg := l.logger()
+	id := accessEntry(ctx).ConnID
+	if lg.Enabled(LevelDebug) {
+		lg.Log(LevelDebug, "socks4 connect", F(KeyConnID, id), F(KeyClient, conn.RemoteAddr()))
+	}
+
+	setReadTimeout(conn, l.timeout())
+	br := bufio.NewReader(conn)
+	addr, err := getSocks4Request(br)
+	if err != nil {
+		lg.Log(LevelWarn, "error getting request", F(KeyConnID, id),
+			F(KeyClient, conn.RemoteAddr()), F(KeyError, err))
+		socks4Reply(conn, socks4RepRejected)
+		return
+	}
+	rawaddr, err := RawAddr(addr)
+	if err != nil {
+		lg.Log(LevelWarn, "error getting request", F(KeyConnID, id),
+			F(KeyClient, conn.RemoteAddr()), F(KeyError, err))
+		socks4Reply(conn, socks4RepRejected)
+		return
+	}
+	l.Handshake(ctx, addr, "")
+	// The reply has only granted or rejected, so wait for the connection
+	// result unlike SOCKS5.
+	remote, err := l.Connect(ctx, rawaddr, addr)
+	if err != nil {
+		socks4Reply(conn, socks4RepRejected)
+		return
+	}
+	if err = socks4Reply(conn, socks4RepGranted); err != nil {
+		remote.Close()
+		return
+	}
+	l.Relay(ctx, &bufferedConn{conn, br}, remote)
+}
+
+// getSocks4Request reads a SOCKS4 CONNECT request. A destination IP of
+// 0.0.0.x with x non-zero means the SOCKS4a extension, the domain name follows
+// the user ID.
+func getSocks4Request(r *bufio.Reader) (host string, err error) {
+	// 1(ver) + 1(cmd) + 2(port) + 4(ip)
+	buf := make([]byte, 8)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return
+	}
+	if buf[0] != socksVer4 {
+		return "", errSocks4Ver
+	}
+	if buf[1] != socksCmdConnect {
+		return "", errSocks4Cmd
+	}
+	port := binary.BigEndian.Uint16(buf[2:4])
+	ip := net.IP(buf[4:8])
+	if _, err = readSocks4String(r); err != nil { // user ID
+		return
+	}
+	host = ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if host, err = readSocks4String(r); err != nil {
+			return
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// readSocks4String reads a null terminated string of at most 255 bytes.
+func readSocks4String(r *bufio.Reader) (string, error) {
+	s, err := r.ReadSlice(0)
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			err = errSocks4TooLong
+		}
+		return "", err
+	}
+	if len(s) > 256 {
+		return "", errSocks4TooLong
+	}
+	return string(s[:len(s)-1]), nil
+}
+
+func socks4Reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{0, rep, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,214 @@
+package shadowsocks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSubscriptionInterval = time.Hour
+	subscriptionTimeout         = 30 * time.Second
+	// maxSubscriptionSize limits the size of the lists fetched.
+	maxSubscriptionSize = 4 << 20
+)
+
+// ParseSIP008 parses an online configuration in the SIP008 format, and
+// returns its servers:
+//
+//	{
+//		"version": 1,
+//		"servers": [{
+//			"id": "27b8a625-4f4b-4428-9f0f-8a2317db7c79",
+//			"remarks": "Name of the server",
+//			"server": "example.com",
+//			"server_port": 8388,
+//			"password": "example",
+//			"method": "aes-256-cfb",
+//			"plugin": "obfs-local",
+//			"plugin_opts": "obfs=http"
+//		}]
+//	}
+//
+// The remarks are the tag of the servers, and the plugin is joined with its
+// options by a semicolon. Other fields are ignored.
+func ParseSIP008(data []byte) ([]*ServerURI, error) {
+	var config struct {
+		Version int `json:"version"`
+		Servers []struct {
+			Remarks    string `json:"remarks"`
+			Server     string `json:"server"`
+			ServerPort int    `json:"server_port"`
+			Password   string `json:"password"`
+			Method     string `json:"method"`
+			Plugin     string `json:"plugin"`
+			PluginOpts string `json:"plugin_opts"`
+		} `json:"servers"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	if config.Version != 1 {
+		return nil, fmt.Errorf("unsupported SIP008 version %d", config.Version)
+	}
+	servers := make([]*ServerURI, 0, len(config.Servers))
+	for i, s := range config.Servers {
+		if s.Server == "" || s.Method == "" || s.ServerPort <= 0 || s.ServerPort > 65535 {
+			return nil, fmt.Errorf("server %d: missing server, server_port or method", i+1)
+		}
+		u := &ServerURI{
+			Method:   s.Method,
+			Password: s.Password,
+			Server:   net.JoinHostPort(s.Server, strconv.Itoa(s.ServerPort)),
+			Plugin:   s.Plugin,
+			Tag:      s.Remarks,
+		}
+		if s.Plugin != "" && s.PluginOpts != "" {
+			u.Plugin += ";" + s.PluginOpts
+		}
+		servers = append(servers, u)
+	}
+	return servers, nil
+}
+
+// Subscription fetches an online server list in the SIP008 format. The ETag
+// of the list avoids downloading it again if not modified.
+type Subscription struct {
+	URL string
+	// CachePath is the file keeping a copy of the last list fetched, read
+	// by Load. No copy is kept if empty.
+	CachePath string
+	// Interval is the time between two fetches by Run, default to 1 hour.
+	Interval time.Duration
+	// Client fetches the list, a client with a 30 seconds timeout is used
+	// if nil.
+	Client *http.Client
+	// Logger replaces the package logger if not nil.
+	Logger Logger
+
+	mu   sync.Mutex
+	etag string
+}
+
+var defaultSubscriptionClient = &http.Client{Timeout: subscriptionTimeout}
+
+// Fetch fetches the list, saving a copy to CachePath. modified is false,
+// with nil servers, if the list didn't change since the last fetch.
+func (s *Subscription) Fetch(ctx context.Context) (servers []*ServerURI, modified bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req = req.WithContext(ctx)
+	s.mu.Lock()
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	s.mu.Unlock()
+	client := s.Client
+	if client == nil {
+		client = defaultSubscriptionClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, false, nil
+	case http.StatusOK:
+	default:
+		return nil, false, fmt.Errorf("subscription: %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSubscriptionSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) > maxSubscriptionSize {
+		return nil, false, fmt.Errorf("subscription: list larger than %d bytes", maxSubscriptionSize)
+	}
+	if servers, err = ParseSIP008(data); err != nil {
+		return nil, false, fmt.Errorf("subscription: %v", err)
+	}
+	if s.CachePath != "" {
+		if err := writeFileAtomic(s.CachePath, data); err != nil {
+			logfTo(loggerOr(s.Logger), LevelWarn, "error saving subscription copy: %v", err)
+		}
+	}
+	s.mu.Lock()
+	s.etag = resp.Header.Get("ETag")
+	s.mu.Unlock()
+	return servers, true, nil
+}
+
+// Load returns the servers of the copy at CachePath.
+func (s *Subscription) Load() ([]*ServerURI, error) {
+	data, err := ioutil.ReadFile(s.CachePath)
+	if err != nil {
+		return nil, err
+	}
+	servers, err := ParseSIP008(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.CachePath, err)
+	}
+	return servers, nil
+}
+
+// Run fetches the list every Interval until ctx is done, and calls update
+// with the servers when the list is modified. Fetch errors are logged, the
+// list is fetched again at the next interval.
+func (s *Subscription) Run(ctx context.Context, update func([]*ServerURI)) {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = defaultSubscriptionInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		servers, modified, err := s.Fetch(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				logfTo(loggerOr(s.Logger), LevelWarn, "error fetching subscription: %v", err)
+			}
+			continue
+		}
+		if modified {
+			update(servers)
+		}
+	}
+}
+
+// writeFileAtomic writes data to a temporary file renamed to path, so that
+// path is never partially written.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package shadowsocks
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+const testSIP008 = `{
+	"version": 1,
+	"servers": [{
+		"id": "27b8a625-4f4b-4428-9f0f-8a2317db7c79",
+		"remarks": "Home",
+		"server": "192.0.2.1",
+		"server_port": 8388,
+		"password": "foobar",
+		"method": "aes-128-cfb"
+	}, {
+		"remarks": "v6",
+		"server": "2001:db8::1",
+		"server_port": 443,
+		"password": "barfoo",
+		"method": "chacha20",
+		"plugin": "obfs-local",
+		"plugin_opts": "obfs=http"
+	}],
+	"bytes_used": 1024
+}`
+
+func TestParseSIP008(t *testing.T) {
+	servers, err := ParseSIP008([]byte(testSIP008))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ServerURI{
+		{Method: "aes-128-cfb", Password: "foobar", Server: "192.0.2.1:8388", Tag: "Home"},
+		{Method: "chacha20", Password: "barfoo", Server: "[2001:db8::1]:443", Plugin: "obfs-local;obfs=http", Tag: "v6"},
+	}
+	if len(servers) != len(want) {
+		t.Fatalf("got %d servers, want %d", len(servers), len(want))
+	}
+	for i, u := range servers {
+		if *u != want[i] {
+			t.Errorf("server %d = %+v, want %+v", i, *u, want[i])
+		}
+	}
+
+	for _, data := range []string{
+		"",
+		`{"version": 2, "servers": []}`,
+		`{"servers": []}`,
+		`{"version": 1, "servers": [{"server": "192.0.2.1", "server_port": 8388, "password": "foobar"}]}`,
+		`{"version": 1, "servers": [{"server": "192.0.2.1", "server_port": 0, "method": "aes-128-cfb"}]}`,
+	} {
+		if _, err := ParseSIP008([]byte(data)); err == nil {
+			t.Errorf("ParseSIP008(%q) accepted", data)
+		}
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	var requests, notModified int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(testSIP008))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "subscription")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &Subscription{URL: ts.URL, CachePath: filepath.Join(dir, "servers.json")}
+	servers, modified, err := s.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modified || len(servers) != 2 {
+		t.Fatalf("first fetch: modified %v with %d servers", modified, len(servers))
+	}
+	servers, modified, err = s.Fetch(context.Background())
+	if err != nil || modified || servers != nil {
+		t.Errorf("second fetch: modified %v with %d servers, error %v", modified, len(servers), err)
+	}
+	if requests != 2 || notModified != 1 {
+		t.Errorf("%d requests with %d not modified, want 2 and 1", requests, notModified)
+	}
+
+	servers, err = s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 || servers[1].Server != "[2001:db8::1]:443" {
+		t.Errorf("loaded servers %v", servers)
+	}
+
+	// a failed fetch keeps the copy
+	s.URL = ts.URL + "/missing.json"
+	if _, _, err = s.Fetch(context.Background()); err == nil {
+		t.Error("fetched a missing list")
+	}
+	if servers, err = s.Load(); err != nil || len(servers) != 2 {
+		t.Errorf("copy lost after a failed fetch: %d servers, error %v", len(servers), err)
+	}
+}
@@ -0,0 +1,31 @@
+package shadowsocks
+
+import "net"
+
+// The socket functions for TPROXY are variables so tests can replace them.
+var (
+	// readFromOrigDst reads a packet from a socket created by
+	// ListenTProxyUDP, returning its source and original destination.
+	readFromOrigDst = readMsgOrigDst
+	// listenReply returns a socket bound to the original destination of
+	// packets, so replies look like coming from it.
+	listenReply = listenTransparentUDP
+)
+
+// ServeTProxyUDP relays the UDP packets redirected by iptables TPROXY to conn,
+// which must be created by ListenTProxyUDP. Replies are sent from the
+// original destination address. The packets from a client to a destination
+// form a session, which ends when no reply is received for UDPTimeout. Like
+// Serve, ErrServerClosed is returned after Shutdown or Close.
+func (l *Local) ServeTProxyUDP(conn *net.UDPConn) error {
+	read := func(b []byte) (n int, src, dst net.Addr, err error) {
+		n, usrc, udst, err := readFromOrigDst(conn, b)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		return n, usrc, udst, nil
+	}
+	return l.servePacket(conn, read, func(dst net.Addr) (net.PacketConn, error) {
+		return listenReply(dst.(*net.UDPAddr))
+	})
+}
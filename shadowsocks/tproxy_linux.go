@@ -0,0 +1,145 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Not all of them are defined by the syscall package.
+const (
+	ipTransparent       = 19 // IP_TRANSPARENT
+	ipRecvOrigDstAddr   = 20 // IP_RECVORIGDSTADDR, also IP_ORIGDSTADDR
+	ipv6RecvOrigDstAddr = 74 // IPV6_RECVORIGDSTADDR, also IPV6_ORIGDSTADDR
+	ipv6Transparent     = 75 // IPV6_TRANSPARENT
+	sizeofSockaddrInet4 = 16
+	sizeofSockaddrInet6 = 28
+)
+
+var errNoOrigDst = errors.New("[udp]tproxy: packet without original destination")
+
+// setTransparent sets the socket options needed for TPROXY. IPv4 options are
+// also set on IPv6 sockets for IPv4-mapped addresses, ignoring errors.
+func setTransparent(fd int, ipv4, recvOrigDst bool) error {
+	if ipv4 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, ipTransparent, 1); err != nil {
+			return err
+		}
+		if recvOrigDst {
+			return syscall.SetsockoptInt(fd, syscall.SOL_IP, ipRecvOrigDstAddr, 1)
+		}
+		return nil
+	}
+	syscall.SetsockoptInt(fd, syscall.SOL_IP, ipTransparent, 1)
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6Transparent, 1); err != nil {
+		return err
+	}
+	if recvOrigDst {
+		syscall.SetsockoptInt(fd, syscall.SOL_IP, ipRecvOrigDstAddr, 1)
+		return syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+	}
+	return nil
+}
+
+// listenUDP returns a transparent UDP socket bound to addr, with
+// SO_REUSEADDR if reuse. Sockets without an IPv4 address are IPv6 ones,
+// also receiving IPv4 packets, unless IPv6 isn't supported.
+func listenUDP(addr *net.UDPAddr, reuse, recvOrigDst bool) (*net.UDPConn, error) {
+	ip4 := addr.IP.To4()
+	if ip4 == nil && addr.IP == nil {
+		if fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_DGRAM, 0); err != nil {
+			ip4 = net.IPv4zero.To4()
+		} else {
+			syscall.Close(fd)
+		}
+	}
+	family := syscall.AF_INET6
+	var sa syscall.Sockaddr
+	if ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa4.Addr[:], ip4)
+		family, sa = syscall.AF_INET, sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		sa = sa6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	f := os.NewFile(uintptr(fd), "tproxy")
+	defer f.Close()
+	if reuse {
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err = setTransparent(fd, ip4 != nil, recvOrigDst); err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	// FilePacketConn uses a copy of the socket, f is closed
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// ListenTProxyUDP listens on the UDP address addr for packets redirected by
+// iptables TPROXY. It requires the CAP_NET_ADMIN capability.
+func ListenTProxyUDP(addr string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return listenUDP(udpAddr, false, true)
+}
+
+// listenTransparentUDP returns a socket bound to addr, which is usually not a
+// local address. Several sockets can be bound to the same address.
+func listenTransparentUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return listenUDP(addr, true, false)
+}
+
+// readMsgOrigDst reads a packet and gets its original destination from the
+// IP_ORIGDSTADDR or IPV6_ORIGDSTADDR control message.
+func readMsgOrigDst(conn *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	// IPv6 sockets may receive both messages for IPv4-mapped addresses
+	oob := make([]byte, syscall.CmsgSpace(sizeofSockaddrInet4)+syscall.CmsgSpace(sizeofSockaddrInet6))
+	var oobn int
+	if n, oobn, _, src, err = conn.ReadMsgUDP(b, oob); err != nil {
+		return
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return
+	}
+	for _, m := range msgs {
+		// sockaddr_in and sockaddr_in6 begin with family and port, the
+		// port is in network byte order
+		switch {
+		case m.Header.Level == syscall.SOL_IP && m.Header.Type == ipRecvOrigDstAddr &&
+			len(m.Data) >= sizeofSockaddrInet4:
+			dst = &net.UDPAddr{
+				IP:   net.IPv4(m.Data[4], m.Data[5], m.Data[6], m.Data[7]),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}
+			return
+		case m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == ipv6RecvOrigDstAddr &&
+			len(m.Data) >= sizeofSockaddrInet6:
+			// family, port, flowinfo, then the address
+			dst = &net.UDPAddr{
+				IP:   append(net.IP(nil), m.Data[8:24]...),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}
+			return
+		}
+	}
+	return n, src, nil, errNoOrigDst
+}
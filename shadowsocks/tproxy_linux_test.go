@@ -0,0 +1,42 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenTProxyUDP(t *testing.T) {
+	conn, err := ListenTProxyUDP("127.0.0.1:0")
+	if err != nil {
+		t.Skip("transparent socket not permitted:", err)
+	}
+	defer conn.Close()
+
+	c, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, src, dst, err := readMsgOrigDst(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || src.String() != c.LocalAddr().String() {
+		t.Errorf("read %q from %s, want ping from %s", buf[:n], src, c.LocalAddr())
+	}
+	// not redirected, so the original destination is the socket itself
+	if dst.String() != conn.LocalAddr().String() {
+		t.Errorf("original destination %s, want %s", dst, conn.LocalAddr())
+	}
+
+	// replies are sent from non-local addresses
+	reply, err := listenTransparentUDP(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply.Close()
+}
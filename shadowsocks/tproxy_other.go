@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import "net"
+
+// ListenTProxyUDP listens on the UDP address addr for packets redirected by
+// iptables TPROXY. Only supported on Linux.
+func ListenTProxyUDP(addr string) (*net.UDPConn, error) {
+	return nil, errRedirUnsupported
+}
+
+func listenTransparentUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errRedirUnsupported
+}
+
+func readMsgOrigDst(conn *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	return 0, nil, nil, errRedirUnsupported
+}
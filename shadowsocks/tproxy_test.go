@@ -0,0 +1,86 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeTProxyUDP(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	srv := NewServer(cipher)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServePacket(pc)
+	defer srv.Close()
+
+	// pretend all packets were redirected from the echo server, and reply
+	// from a local address as binding to it is not possible
+	defer func(read func(*net.UDPConn, []byte) (int, *net.UDPAddr, *net.UDPAddr, error),
+		listen func(*net.UDPAddr) (*net.UDPConn, error)) {
+		readFromOrigDst, listenReply = read, listen
+	}(readFromOrigDst, listenReply)
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	readFromOrigDst = func(conn *net.UDPConn, b []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+		n, src, err := conn.ReadFromUDP(b)
+		return n, src, echoAddr, err
+	}
+	listenReply = func(*net.UDPAddr) (*net.UDPConn, error) {
+		return net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := newRecordObserver()
+	l := NewLocal([]*Upstream{{Server: pc.LocalAddr().String(), Cipher: cipher}}, nil)
+	l.Observer = obs
+	l.UDPTimeout = 100 * time.Millisecond
+	done := make(chan error, 1)
+	go func() { done <- l.ServeTProxyUDP(conn) }()
+
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.WriteTo([]byte("ping"), conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("got %q, want ping", buf[:n])
+	}
+
+	e := waitClosed(t, obs)
+	obs.check(t, "udp created", "udp expired")
+	if e.BytesUp != 4 || e.BytesDown != 4 {
+		t.Errorf("expired with %d bytes up %d down, want 4 4", e.BytesUp, e.BytesDown)
+	}
+	if e.Target != echoAddr.String() || e.Client != c.LocalAddr().String() {
+		t.Errorf("session from %s to %s, want %s to %s", e.Client, e.Target, c.LocalAddr(), echoAddr)
+	}
+
+	l.Close()
+	select {
+	case err = <-done:
+		if err != ErrServerClosed {
+			t.Errorf("ServeTProxyUDP returned %v after Close", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeTProxyUDP not returned after Close")
+	}
+}
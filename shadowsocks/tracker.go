@@ -0,0 +1,104 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// shutdownPollInterval is how often Shutdown checks whether all connections
+// are finished.
+var shutdownPollInterval = 100 * time.Millisecond
+
+// connTracker keeps the listeners and active connections of a Server or
+// Local, so they can be closed on shutdown.
+type connTracker struct {
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+}
+
+func (t *connTracker) trackListener(ln net.Listener, add bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if add {
+		if t.closed {
+			return false
+		}
+		if t.listeners == nil {
+			t.listeners = make(map[net.Listener]struct{})
+		}
+		t.listeners[ln] = struct{}{}
+	} else {
+		delete(t.listeners, ln)
+	}
+	return true
+}
+
+func (t *connTracker) trackConn(c net.Conn, add bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if add {
+		if t.closed {
+			return false
+		}
+		if t.conns == nil {
+			t.conns = make(map[net.Conn]struct{})
+		}
+		t.conns[c] = struct{}{}
+	} else {
+		delete(t.conns, c)
+	}
+	return true
+}
+
+func (t *connTracker) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// closeListeners marks the tracker closed and closes all listeners. more is
+// called with the lock held to close other resources.
+func (t *connTracker) closeListeners(more func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for ln := range t.listeners {
+		ln.Close()
+	}
+	if more != nil {
+		more()
+	}
+}
+
+func (t *connTracker) closeConns() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c := range t.conns {
+		c.Close()
+	}
+}
+
+// waitConns waits until all connections are finished. If ctx is done before
+// that, remaining connections are closed and ctx.Err() is returned.
+func (t *connTracker) waitConns(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		t.mu.Lock()
+		n := len(t.conns)
+		t.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			t.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
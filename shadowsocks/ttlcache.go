@@ -0,0 +1,65 @@
+package shadowsocks
+
+import (
+	"sync"
+	"time"
+)
+
+type ttlCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// ttlCache keeps at most size values until they expire.
+type ttlCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]ttlCacheEntry
+}
+
+func newTTLCache(size int) *ttlCache {
+	return &ttlCache{size: size, entries: make(map[string]ttlCacheEntry)}
+}
+
+// get returns the value of key if it's not expired at now.
+func (c *ttlCache) get(key string, now time.Time) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+// put stores value until expires, making room for it if the cache is full.
+func (c *ttlCache) put(key string, value interface{}, expires, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[key] = ttlCacheEntry{value: value, expires: expires}
+}
+
+// evict removes expired entries, or a random one if none is expired. It's
+// called with c.mu held.
+func (c *ttlCache) evict(now time.Time) {
+	n := len(c.entries)
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	if len(c.entries) < n {
+		return
+	}
+	for k := range c.entries {
+		delete(c.entries, k)
+		return
+	}
+}
@@ -0,0 +1,87 @@
+package shadowsocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// tunnelAddr returns the address of target, which is a UDPAddr for IP
+// addresses. Domain names are resolved by the server.
+func tunnelAddr(network, target string) (net.Addr, error) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("shadowsocks: tunnel target %s %v", target, err)
+	}
+	if net.ParseIP(host) != nil && network == "udp" {
+		return net.ResolveUDPAddr(network, target)
+	}
+	return &ProxyAddr{network: network, address: target}, nil
+}
+
+// TunnelHandler is the InboundHandler forwarding all connections to a fixed
+// target, like port forwarding. Create it with NewTunnelHandler.
+type TunnelHandler struct {
+	target  string
+	rawaddr []byte
+}
+
+// NewTunnelHandler returns a handler forwarding connections to target, which
+// is a host:port address.
+func NewTunnelHandler(target string) (*TunnelHandler, error) {
+	addr, err := tunnelAddr("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	rawaddr, err := rawAddrOf(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &TunnelHandler{target: target, rawaddr: rawaddr}, nil
+}
+
+func (h *TunnelHandler) ServeInbound(ctx context.Context, conn net.Conn, l *Local) {
+	l.Handshake(ctx, h.target, "")
+	remote, err := l.Connect(ctx, h.rawaddr, h.target)
+	if err != nil {
+		return
+	}
+	l.Relay(ctx, conn, remote)
+}
+
+// ServeTunnelUDP forwards the UDP packets received on conn to target through
+// the servers, replies are sent back with conn. The packets from a client
+// form a session, which ends when no reply is received for UDPTimeout. Like
+// Serve, ErrServerClosed is returned after Shutdown or Close.
+func (l *Local) ServeTunnelUDP(conn net.PacketConn, target string) error {
+	dst, err := tunnelAddr("udp", target)
+	if err != nil {
+		return err
+	}
+	read := func(b []byte) (n int, src, _ net.Addr, err error) {
+		n, src, err = conn.ReadFrom(b)
+		return n, src, dst, err
+	}
+	return l.servePacket(conn, read, nil)
+}
+
+// ParseTunnel parses a tunnel specification in the form
+// [listen_host:]listen_port=target_host:target_port.
+func ParseTunnel(spec string) (listen, target string, err error) {
+	i := strings.IndexByte(spec, '=')
+	if i < 0 {
+		return "", "", fmt.Errorf("shadowsocks: tunnel %q not in listen=target form", spec)
+	}
+	listen, target = spec[:i], spec[i+1:]
+	if !strings.Contains(listen, ":") {
+		listen = ":" + listen
+	}
+	if _, _, err = net.SplitHostPort(listen); err != nil {
+		return "", "", fmt.Errorf("shadowsocks: tunnel %q %v", spec, err)
+	}
+	if _, _, err = net.SplitHostPort(target); err != nil {
+		return "", "", fmt.Errorf("shadowsocks: tunnel %q %v", spec, err)
+	}
+	return
+}
@@ -0,0 +1,153 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTunnelHandler(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	srv, srvAddr := startServer(t, cipher)
+	defer srv.Close()
+	h, err := NewTunnelHandler(echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, addr := startLocal(t, []*Upstream{{Server: srvAddr, Cipher: cipher}}, h)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	checkEcho(t, c)
+}
+
+func TestTunnelHandlerOTA(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb-auth", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	// the server checks one time auth of the requests asking for it
+	srv, srvAddr := startServer(t, plain)
+	defer srv.Close()
+	h, err := NewTunnelHandler(echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the header of the handler is shared by the connections with and
+	// without one time auth, it must not be modified
+	l, addr := startLocal(t, []*Upstream{{Server: srvAddr, Cipher: cipher}}, h)
+	defer l.Close()
+	pl, plainLocal := startLocal(t, []*Upstream{{Server: srvAddr, Cipher: plain}}, h)
+	defer pl.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		for _, a := range []string{addr, plainLocal} {
+			wg.Add(1)
+			go func(a string) {
+				defer wg.Done()
+				c, err := net.Dial("tcp", a)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+				// checkEcho can't be used out of the test goroutine
+				buf := make([]byte, 5)
+				if _, err = c.Write([]byte("hello")); err == nil {
+					_, err = io.ReadFull(c, buf)
+				}
+				if err != nil || string(buf) != "hello" {
+					t.Errorf("got %q, %v through %s", buf, err, a)
+				}
+			}(a)
+		}
+	}
+	wg.Wait()
+}
+
+func TestServeTunnelUDP(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	srv := NewServer(cipher)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServePacket(pc)
+	defer srv.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLocal([]*Upstream{{Server: pc.LocalAddr().String(), Cipher: cipher}}, nil)
+	go l.ServeTunnelUDP(conn, echo.LocalAddr().String())
+	defer l.Close()
+
+	c, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"ping", "pong"} {
+		if _, err = c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Errorf("got %q, want %q", buf[:n], msg)
+		}
+	}
+}
+
+func TestParseTunnel(t *testing.T) {
+	tests := []struct {
+		spec, listen, target string
+		ok                   bool
+	}{
+		{"127.0.0.1:5353=8.8.8.8:53", "127.0.0.1:5353", "8.8.8.8:53", true},
+		{"5353=example.com:53", ":5353", "example.com:53", true},
+		{"[::1]:5353=[2001:4860:4860::8888]:53", "[::1]:5353", "[2001:4860:4860::8888]:53", true},
+		{"5353", "", "", false},
+		{"5353=8.8.8.8", "", "", false},
+	}
+	for _, tt := range tests {
+		listen, target, err := ParseTunnel(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseTunnel(%q) error %v", tt.spec, err)
+			continue
+		}
+		if listen != tt.listen || target != tt.target {
+			t.Errorf("ParseTunnel(%q) = %q %q, want %q %q", tt.spec, listen, target, tt.listen, tt.target)
+		}
+	}
+}
@@ -14,7 +14,6 @@ const (
 var (
 	errPacketTooSmall  = fmt.Errorf("[udp]read error: cannot decrypt, received packet is smaller than ivLen")
 	errPacketTooLarge  = fmt.Errorf("[udp]read error: received packet is latger than maxPacketSize(%d)", maxPacketSize)
-	errBufferTooSmall  = fmt.Errorf("[udp]read error: given buffer is too small to hold data")
 	errPacketOtaFailed = fmt.Errorf("[udp]read error: received packet has invalid ota")
 )
 
@@ -39,8 +38,8 @@ func (c *SecurePacketConn) Close() error {
 func (c *SecurePacketConn) ReadFrom(b []byte) (n int, src net.Addr, err error) {
 	ota := false
 	cipher := c.Copy()
-	buf := make([]byte, 4096)
-	n, src, err = c.PacketConn.ReadFrom(buf)
+	// the packet is read in b and decrypted in place, b must hold the iv
+	n, src, err = c.PacketConn.ReadFrom(b)
 	if err != nil {
 		return
 	}
@@ -49,19 +48,15 @@ func (c *SecurePacketConn) ReadFrom(b []byte) (n int, src net.Addr, err error) {
 		return 0, nil, errPacketTooSmall
 	}
 
-	if len(b) < n-c.info.ivLen {
-		err = errBufferTooSmall // just a warning
-	}
-
 	iv := make([]byte, c.info.ivLen)
-	copy(iv, buf[:c.info.ivLen])
+	copy(iv, b[:c.info.ivLen])
 
 	if err = cipher.initDecrypt(iv); err != nil {
 		return
 	}
 
-	cipher.decrypt(b[0:], buf[c.info.ivLen:n])
-	n -= c.info.ivLen
+	n = copy(b, b[c.info.ivLen:n])
+	cipher.decrypt(b[:n], b[:n])
 	if b[idType]&OneTimeAuthMask > 0 {
 		ota = true
 	}
@@ -74,7 +69,7 @@ func (c *SecurePacketConn) ReadFrom(b []byte) (n int, src net.Addr, err error) {
 		key := cipher.key
 		actualHmacSha1Buf := HmacSha1(append(iv, key...), b[:n-lenHmacSha1])
 		if !bytes.Equal(b[n-lenHmacSha1:n], actualHmacSha1Buf) {
-			Debug.Printf("verify one time auth failed, iv=%v key=%v data=%v", iv, key, b)
+			Log(LevelDebug, "udp one time auth verification failed", F(KeyClient, src))
 			return 0, src, errPacketOtaFailed
 		}
 		n -= lenHmacSha1
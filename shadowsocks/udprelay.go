@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -28,22 +29,44 @@ const (
 )
 
 var (
-	reqList            = newReqList()
-	natlist            = newNatTable()
+	defaultUDPRelay    = newUDPRelay(udpTimeout, accessLogObserver{}, nil)
 	udpTimeout         = 30 * time.Second
 	reqListRefreshTime = 5 * time.Minute
 )
 
+// natEntry is the socket relaying packets of one client, with statistics for
+// the access log.
+type natEntry struct {
+	net.PacketConn
+	id       uint64
+	start    time.Time
+	up       int64 // bytes sent to destinations, accessed atomically
+	mu       sync.Mutex
+	writeErr error
+}
+
+func (e *natEntry) setWriteErr(err error) {
+	e.mu.Lock()
+	e.writeErr = err
+	e.mu.Unlock()
+}
+
+func (e *natEntry) getWriteErr() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.writeErr
+}
+
 type natTable struct {
 	sync.Mutex
-	conns map[string]net.PacketConn
+	conns map[string]*natEntry
 }
 
 func newNatTable() *natTable {
-	return &natTable{conns: map[string]net.PacketConn{}}
+	return &natTable{conns: map[string]*natEntry{}}
 }
 
-func (table *natTable) Delete(index string) net.PacketConn {
+func (table *natTable) Delete(index string) *natEntry {
 	table.Lock()
 	defer table.Unlock()
 	c, ok := table.conns[index]
@@ -54,15 +77,26 @@ func (table *natTable) Delete(index string) net.PacketConn {
 	return nil
 }
 
-func (table *natTable) Get(index string) (c net.PacketConn, ok bool, err error) {
+// closeAll closes all the relaying sockets, which ends their pipe loops.
+func (table *natTable) closeAll() {
+	table.Lock()
+	defer table.Unlock()
+	for _, c := range table.conns {
+		c.Close()
+	}
+}
+
+func (table *natTable) Get(index string) (c *natEntry, ok bool, err error) {
 	table.Lock()
 	defer table.Unlock()
 	c, ok = table.conns[index]
 	if !ok {
-		c, err = net.ListenPacket("udp", "")
+		var pc net.PacketConn
+		pc, err = net.ListenPacket("udp", "")
 		if err != nil {
 			return nil, false, err
 		}
+		c = &natEntry{PacketConn: pc, id: NewConnID(), start: time.Now()}
 		table.conns[index] = c
 	}
 	return
@@ -70,31 +104,40 @@ func (table *natTable) Get(index string) (c net.PacketConn, ok bool, err error)
 
 type requestHeaderList struct {
 	sync.Mutex
-	List map[string]([]byte)
+	List      map[string]([]byte)
+	refreshed time.Time
 }
 
 func newReqList() *requestHeaderList {
-	ret := &requestHeaderList{List: map[string]([]byte){}}
-	go func() {
-		for {
-			time.Sleep(reqListRefreshTime)
-			ret.Refresh()
-		}
-	}()
-	return ret
+	return &requestHeaderList{List: map[string]([]byte){}, refreshed: time.Now()}
 }
 
 func (r *requestHeaderList) Refresh() {
 	r.Lock()
 	defer r.Unlock()
+	r.refresh()
+}
+
+func (r *requestHeaderList) refresh() {
 	for k, _ := range r.List {
 		delete(r.List, k)
 	}
+	r.refreshed = time.Now()
+}
+
+// expire clears the list every reqListRefreshTime. It's done upon access
+// instead of in a goroutine so that lists of stopped relays can be garbage
+// collected.
+func (r *requestHeaderList) expire() {
+	if time.Since(r.refreshed) >= reqListRefreshTime {
+		r.refresh()
+	}
 }
 
 func (r *requestHeaderList) Get(dstaddr string) (req []byte, ok bool) {
 	r.Lock()
 	defer r.Unlock()
+	r.expire()
 	req, ok = r.List[dstaddr]
 	return
 }
@@ -102,10 +145,37 @@ func (r *requestHeaderList) Get(dstaddr string) (req []byte, ok bool) {
 func (r *requestHeaderList) Put(dstaddr string, req []byte) {
 	r.Lock()
 	defer r.Unlock()
+	r.expire()
 	r.List[dstaddr] = req
 	return
 }
 
+// udpRelay holds the state of the UDP relay of a server socket: the NAT table
+// of client sessions and the cached request headers of destinations.
+type udpRelay struct {
+	nat     *natTable
+	reqs    *requestHeaderList
+	timeout time.Duration
+	obs     Observer
+	logger  Logger // package logger if nil
+}
+
+func newUDPRelay(timeout time.Duration, obs Observer, logger Logger) *udpRelay {
+	return &udpRelay{
+		nat:     newNatTable(),
+		reqs:    newReqList(),
+		timeout: timeout,
+		obs:     obs,
+		logger:  logger,
+	}
+}
+
+func (r *udpRelay) log(level LogLevel, msg string, fields ...Field) {
+	if lg := loggerOr(r.logger); lg.Enabled(level) {
+		lg.Log(level, msg, fields...)
+	}
+}
+
 func parseHeaderFromAddr(addr net.Addr) ([]byte, int) {
 	// if the request address type is domain, it cannot be reverselookuped
 	ip, port, err := net.SplitHostPort(addr.String())
@@ -130,26 +200,37 @@ func parseHeaderFromAddr(addr net.Addr) ([]byte, int) {
 	return buf[:1+iplen+2], 1 + iplen + 2
 }
 
+// Pipeloop relays packets read from readClose back to writeAddr until no
+// packet is received for udpTimeout.
 func Pipeloop(write net.PacketConn, writeAddr net.Addr, readClose net.PacketConn) {
+	defaultUDPRelay.pipeloop(write, writeAddr, readClose)
+}
+
+// pipeloop is Pipeloop, returning the number of payload bytes relayed and
+// the error that ended the loop.
+func (r *udpRelay) pipeloop(write net.PacketConn, writeAddr net.Addr, readClose net.PacketConn) (relayed int64, err error) {
 	buf := leakyBuf.Get()
 	defer leakyBuf.Put(buf)
 	defer readClose.Close()
 	for {
-		readClose.SetDeadline(time.Now().Add(udpTimeout))
-		n, raddr, err := readClose.ReadFrom(buf)
+		readClose.SetDeadline(time.Now().Add(r.timeout))
+		var n int
+		var raddr net.Addr
+		n, raddr, err = readClose.ReadFrom(buf)
 		if err != nil {
 			if ne, ok := err.(*net.OpError); ok {
 				if ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE {
 					// log too many open file error
 					// EMFILE is process reaches open file limits, ENFILE is system limit
-					Debug.Println("[udp]read error:", err)
+					r.log(LevelWarn, "udp read error", F(KeyError, err))
 				}
 			}
-			Debug.Printf("[udp]closed pipe %s<-%s\n", writeAddr, readClose.LocalAddr())
+			r.log(LevelDebug, "udp closed pipe", F(KeyClient, writeAddr), F("local", readClose.LocalAddr()))
 			return
 		}
+		relayed += int64(n)
 		// need improvement here
-		if req, ok := reqList.Get(raddr.String()); ok {
+		if req, ok := r.reqs.Get(raddr.String()); ok {
 			write.WriteTo(append(req, buf[:n]...), writeAddr)
 		} else {
 			header, hlen := parseHeaderFromAddr(raddr)
@@ -159,6 +240,10 @@ func Pipeloop(write net.PacketConn, writeAddr net.Addr, readClose net.PacketConn
 }
 
 func handleUDPConnection(handle *SecurePacketConn, n int, src net.Addr, receive []byte) {
+	defaultUDPRelay.handle(handle, n, src, receive)
+}
+
+func (r *udpRelay) handle(handle *SecurePacketConn, n int, src net.Addr, receive []byte) {
 	var dstIP net.IP
 	var reqLen int
 	var ota bool
@@ -175,78 +260,99 @@ func handleUDPConnection(handle *SecurePacketConn, n int, src net.Addr, receive
 	case typeIPv4:
 		reqLen = lenIPv4
 		if len(receive) < reqLen {
-			Debug.Println("[udp]invalid received message.")
+			r.log(LevelDebug, "udp invalid received message", F(KeyClient, src))
 		}
 		dstIP = net.IP(receive[idIP0 : idIP0+net.IPv4len])
 	case typeIPv6:
 		reqLen = lenIPv6
 		if len(receive) < reqLen {
-			Debug.Println("[udp]invalid received message.")
+			r.log(LevelDebug, "udp invalid received message", F(KeyClient, src))
 		}
 		dstIP = net.IP(receive[idIP0 : idIP0+net.IPv6len])
 	case typeDm:
 		reqLen = int(receive[idDmLen]) + lenDmBase
 		if len(receive) < reqLen {
-			Debug.Println("[udp]invalid received message.")
+			r.log(LevelDebug, "udp invalid received message", F(KeyClient, src))
 		}
 		name := string(receive[idDm0 : idDm0+int(receive[idDmLen])])
 		// avoid panic: syscall: string with NUL passed to StringToUTF16 on windows.
 		if strings.ContainsRune(name, 0x00) {
-			fmt.Println("[udp]invalid domain name.")
+			r.log(LevelDebug, "udp invalid domain name", F(KeyClient, src))
 			return
 		}
 		dIP, err := net.ResolveIPAddr("ip", name) // carefully with const type
 		if err != nil {
-			Debug.Printf("[udp]failed to resolve domain name: %s\n", string(receive[idDm0:idDm0+receive[idDmLen]]))
+			r.log(LevelDebug, "udp failed to resolve domain name", F(KeyClient, src), F(KeyTarget, name), F(KeyError, err))
 			return
 		}
 		dstIP = dIP.IP
 	default:
-		Debug.Printf("[udp]addrType %d not supported", addrType)
+		r.log(LevelDebug, "udp address type not supported", F(KeyClient, src), F("addr_type", addrType))
 		return
 	}
 	dst := &net.UDPAddr{
 		IP:   dstIP,
 		Port: int(binary.BigEndian.Uint16(receive[reqLen-2 : reqLen])),
 	}
-	if _, ok := reqList.Get(dst.String()); !ok {
+	if _, ok := r.reqs.Get(dst.String()); !ok {
 		req := make([]byte, reqLen)
 		copy(req, receive)
-		reqList.Put(dst.String(), req)
+		r.reqs.Put(dst.String(), req)
 	}
 
-	remote, exist, err := natlist.Get(src.String())
+	remote, exist, err := r.nat.Get(src.String())
 	if err != nil {
 		return
 	}
 	if !exist {
-		Debug.Printf("[udp]new client %s->%s via %s ota=%v\n", src, dst, remote.LocalAddr(), ota)
+		r.log(LevelDebug, "udp new client", F(KeyConnID, remote.id), F(KeyClient, src), F(KeyTarget, dst),
+			F("local", remote.LocalAddr()), F("ota", ota))
+		_, port, _ := net.SplitHostPort(handle.LocalAddr().String())
+		entry := &AccessEntry{
+			ConnID:  remote.id,
+			Network: "udp",
+			Client:  src.String(),
+			Port:    port,
+			Target:  dst.String(),
+			OTA:     ota,
+			Start:   remote.start,
+		}
+		r.obs.UDPSessionCreated(entry)
 		go func() {
+			var down int64
+			var err error
 			if compatiblemode {
-				Pipeloop(handle.ForceOTA(), src, remote)
+				down, err = r.pipeloop(handle.ForceOTA(), src, remote)
 			} else {
-				Pipeloop(handle, src, remote)
+				down, err = r.pipeloop(handle, src, remote)
 			}
 
-			natlist.Delete(src.String())
+			r.nat.Delete(src.String())
+			entry.BytesUp = atomic.LoadInt64(&remote.up)
+			entry.BytesDown = down
+			entry.Reason = CloseReasonOf(remote.getWriteErr(), err)
+			r.obs.UDPSessionExpired(entry)
 		}()
 	} else {
-		Debug.Printf("[udp]using cached client %s->%s via %s ota=%v\n", src, dst, remote.LocalAddr(), ota)
+		r.log(LevelDebug, "udp using cached client", F(KeyConnID, remote.id), F(KeyClient, src), F(KeyTarget, dst),
+			F("local", remote.LocalAddr()), F("ota", ota))
 	}
 	if remote == nil {
 		fmt.Println("WTF")
 	}
-	remote.SetDeadline(time.Now().Add(udpTimeout))
-	_, err = remote.WriteTo(receive[reqLen:n], dst)
+	remote.SetDeadline(time.Now().Add(r.timeout))
+	nw, err := remote.WriteTo(receive[reqLen:n], dst)
+	atomic.AddInt64(&remote.up, int64(nw))
 	if err != nil {
+		remote.setWriteErr(err)
 		if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
 			// log too many open file error
 			// EMFILE is process reaches open file limits, ENFILE is system limit
-			Debug.Println("[udp]write error:", err)
+			r.log(LevelWarn, "udp write error", F(KeyConnID, remote.id), F(KeyError, err))
 		} else {
-			Debug.Println("[udp]error connecting to:", dst, err)
+			r.log(LevelDebug, "udp error connecting to target", F(KeyConnID, remote.id), F(KeyTarget, dst), F(KeyError, err))
 		}
-		if conn := natlist.Delete(src.String()); conn != nil {
+		if conn := r.nat.Delete(src.String()); conn != nil {
 			conn.Close()
 		}
 	}
@@ -255,11 +361,16 @@ func handleUDPConnection(handle *SecurePacketConn, n int, src net.Addr, receive
 }
 
 func ReadAndHandleUDPReq(c *SecurePacketConn) error {
+	return defaultUDPRelay.readAndHandle(c)
+}
+
+func (r *udpRelay) readAndHandle(c *SecurePacketConn) error {
 	buf := leakyBuf.Get()
 	n, src, err := c.ReadFrom(buf[0:])
 	if err != nil {
+		leakyBuf.Put(buf)
 		return err
 	}
-	go handleUDPConnection(c, n, src, buf)
+	go r.handle(c, n, src, buf)
 	return nil
 }
@@ -0,0 +1,125 @@
+package shadowsocks
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var errURI = errors.New("shadowsocks: invalid ss:// URI")
+
+// ServerURI is a server shared as an ss:// URI.
+type ServerURI struct {
+	Method   string
+	Password string
+	Server   string // host:port
+	// Plugin is the SIP003 plugin with its options, separated by
+	// semicolons, such as "obfs-local;obfs=http".
+	Plugin string
+	// Tag is the name of the server.
+	Tag string
+}
+
+// decodeURIBase64 decodes s in base64, with or without padding, in the
+// standard or URL alphabet, as found in URIs.
+func decodeURIBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	s = strings.Replace(strings.Replace(s, "+", "-", -1), "/", "_", -1)
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// ParseURI parses an ss:// URI in the SIP002 form:
+//
+//	ss://base64url(method:password)@host:port/?plugin=name%3Bopts#tag
+//
+// where the userinfo may also be method:password with the password percent
+// encoded, or in the legacy form:
+//
+//	ss://base64(method:password@host:port)#tag
+//
+// The errors don't contain the URI, which has the password.
+func ParseURI(s string) (*ServerURI, error) {
+	const scheme = "ss://"
+	if len(s) < len(scheme) || !strings.EqualFold(s[:len(scheme)], scheme) {
+		return nil, errURI
+	}
+	rest := s[len(scheme):]
+	u := &ServerURI{}
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		// percent encoded, + is not a space
+		tag, err := url.QueryUnescape(strings.Replace(rest[i+1:], "+", "%2B", -1))
+		if err != nil {
+			return nil, errURI
+		}
+		u.Tag, rest = tag, rest[:i]
+	}
+
+	var userinfo string
+	if at := strings.LastIndex(rest, "@"); at >= 0 {
+		userinfo, rest = rest[:at], rest[at+1:]
+		if i := strings.IndexByte(rest, '?'); i >= 0 {
+			query, err := url.ParseQuery(rest[i+1:])
+			if err != nil {
+				return nil, errURI
+			}
+			u.Plugin, rest = query.Get("plugin"), rest[:i]
+		}
+		u.Server = strings.TrimSuffix(rest, "/")
+		if i := strings.IndexByte(userinfo, ':'); i >= 0 {
+			password, err := url.QueryUnescape(strings.Replace(userinfo[i+1:], "+", "%2B", -1))
+			if err != nil {
+				return nil, errURI
+			}
+			u.Method, u.Password = userinfo[:i], password
+		} else {
+			b, err := decodeURIBase64(userinfo)
+			if err != nil {
+				return nil, errURI
+			}
+			userinfo = string(b)
+		}
+	} else {
+		// legacy form
+		b, err := decodeURIBase64(rest)
+		if err != nil {
+			return nil, errURI
+		}
+		at := strings.LastIndex(string(b), "@")
+		if at < 0 {
+			return nil, errURI
+		}
+		userinfo, u.Server = string(b[:at]), string(b[at+1:])
+	}
+	if u.Method == "" {
+		i := strings.IndexByte(userinfo, ':')
+		if i < 0 {
+			return nil, errURI
+		}
+		u.Method, u.Password = userinfo[:i], userinfo[i+1:]
+	}
+
+	host, port, err := net.SplitHostPort(u.Server)
+	if err != nil || host == "" || u.Method == "" {
+		return nil, errURI
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return nil, errURI
+	}
+	u.Method = strings.ToLower(u.Method)
+	return u, nil
+}
+
+// String returns the URI in the SIP002 form.
+func (u *ServerURI) String() string {
+	s := "ss://" + base64.RawURLEncoding.EncodeToString([]byte(u.Method+":"+u.Password)) + "@" + u.Server
+	if u.Plugin != "" {
+		s += "/?" + url.Values{"plugin": {u.Plugin}}.Encode()
+	}
+	if u.Tag != "" {
+		s += "#" + strings.Replace(url.QueryEscape(u.Tag), "+", "%20", -1)
+	}
+	return s
+}
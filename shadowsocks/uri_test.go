@@ -0,0 +1,114 @@
+package shadowsocks
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestServerURIRoundTrip(t *testing.T) {
+	tests := []ServerURI{
+		{Method: "aes-128-cfb", Password: "foobar", Server: "192.0.2.1:8388"},
+		{Method: "chacha20", Password: "p@ss:w/rd+=", Server: "ss.example.com:443", Tag: "Home server #1"},
+		{Method: "aes-256-cfb", Password: "foobar", Server: "[2001:db8::1]:8388", Tag: "v6"},
+		{Method: "rc4-md5", Password: "foobar", Server: "[::1]:8388",
+			Plugin: "obfs-local;obfs=http;obfs-host=www.example.com"},
+		{Method: "aes-128-cfb", Password: "", Server: "192.0.2.1:1", Plugin: "v2ray-plugin;path=/ws?a=b", Tag: "100%"},
+	}
+	for _, want := range tests {
+		s := want.String()
+		if strings.ContainsAny(s, " ;") || strings.Count(s, "#") > 1 {
+			t.Errorf("%+v: unescaped characters in %s", want, s)
+		}
+		got, err := ParseURI(s)
+		if err != nil {
+			t.Errorf("ParseURI(%q) error %v", s, err)
+			continue
+		}
+		if *got != want {
+			t.Errorf("ParseURI(%q) = %+v, want %+v", s, *got, want)
+		}
+	}
+}
+
+func TestParseURI(t *testing.T) {
+	legacy := "ss://" + base64.StdEncoding.EncodeToString([]byte("AES-256-CFB:p@ss@192.0.2.1:8388"))
+	tests := []struct {
+		uri  string
+		want ServerURI
+	}{
+		// examples of SIP002
+		{"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888#Example1",
+			ServerURI{Method: "aes-128-gcm", Password: "test", Server: "192.168.100.1:8888", Tag: "Example1"}},
+		{"ss://cmM0LW1kNTpwYXNzd2Q@192.168.100.1:8888/?plugin=obfs-local%3Bobfs%3Dhttp#Example2",
+			ServerURI{Method: "rc4-md5", Password: "passwd", Server: "192.168.100.1:8888",
+				Plugin: "obfs-local;obfs=http", Tag: "Example2"}},
+		// padded userinfo, no slash before the query
+		{"ss://cmM0LW1kNTpwYXNzd2Q=@[2001:db8::1]:8888?plugin=obfs-local%3Bobfs%3Dtls",
+			ServerURI{Method: "rc4-md5", Password: "passwd", Server: "[2001:db8::1]:8888", Plugin: "obfs-local;obfs=tls"}},
+		// percent encoded userinfo
+		{"ss://2022-blake3-aes-256-gcm:YctPZ6U7xPPcU%2Bgp3u%2B0tx%2FtRizJN9K8y%2BuKlW2qjlI%3D@192.168.100.1:8888#Example3",
+			ServerURI{Method: "2022-blake3-aes-256-gcm", Password: "YctPZ6U7xPPcU+gp3u+0tx/tRizJN9K8y+uKlW2qjlI=",
+				Server: "192.168.100.1:8888", Tag: "Example3"}},
+		{legacy + "#old%20one",
+			ServerURI{Method: "aes-256-cfb", Password: "p@ss", Server: "192.0.2.1:8388", Tag: "old one"}},
+		{strings.TrimRight(legacy, "="),
+			ServerURI{Method: "aes-256-cfb", Password: "p@ss", Server: "192.0.2.1:8388"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseURI(tt.uri)
+		if err != nil {
+			t.Errorf("ParseURI(%q) error %v", tt.uri, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("ParseURI(%q) = %+v, want %+v", tt.uri, *got, tt.want)
+		}
+	}
+
+	for _, uri := range []string{
+		"",
+		"http://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888",
+		"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1",
+		"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:88888",
+		"ss://YWVzLTEyOC1nY206dGVzdA@:8888",
+		"ss://dGVzdA@192.168.100.1:8888",
+		"ss://:test@192.168.100.1:8888",
+		"ss://!!!@192.168.100.1:8888",
+		"ss://" + base64.StdEncoding.EncodeToString([]byte("aes-256-cfb:foobar")),
+	} {
+		if _, err := ParseURI(uri); err == nil {
+			t.Errorf("ParseURI(%q) accepted", uri)
+		}
+	}
+}
+
+func TestConfigServerURIs(t *testing.T) {
+	config := &Config{
+		ServerPassword: [][]string{{"192.0.2.1:8388", "foobar", "aes-128-cfb"}},
+		ServerURIs: []string{
+			(&ServerURI{Method: "aes-256-cfb", Password: "barfoo", Server: "[2001:db8::1]:8388"}).String(),
+		},
+		ServerWeights: map[string]int{"[2001:db8::1]:8388": 2},
+	}
+	upstreams, err := config.Upstreams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upstreams) != 2 || upstreams[0].Server != "192.0.2.1:8388" ||
+		upstreams[1].Server != "[2001:db8::1]:8388" || upstreams[1].Weight != 2 {
+		t.Fatalf("got upstreams %v", upstreams)
+	}
+	if upstreams[0].Cipher == upstreams[1].Cipher {
+		t.Error("servers with different passwords share the cipher")
+	}
+
+	config.ServerURIs = append(config.ServerURIs, "ss://YWVzLTEyOC1jZmI6Zm9vYmFy@192.0.2.2:8388/?plugin=obfs-local")
+	if _, err = config.Upstreams(); err == nil || !strings.Contains(err.Error(), "plugin") {
+		t.Errorf("server with plugin accepted, error %v", err)
+	}
+	config.ServerURIs = []string{"ss://bad"}
+	if _, err = config.Upstreams(); err == nil {
+		t.Error("bad URI accepted")
+	}
+}